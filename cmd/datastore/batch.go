@@ -0,0 +1,124 @@
+package datastore
+
+import "encoding/binary"
+
+// WriteBatch collects puts and deletes that are applied atomically: after
+// a crash either all of them are recovered or none.
+type WriteBatch struct {
+	db *Db
+	// Maps the keys of the operations to stored keys.
+	key func(key string) (string, error)
+	ops []entry
+	// The first error of preparing an operation, returned by Commit.
+	err error
+}
+
+func (db *Db) NewBatch() *WriteBatch {
+	return &WriteBatch{db: db, key: userKey}
+}
+
+func (b *WriteBatch) Put(key, value string, opts ...WriteOption) {
+	key, err := b.key(key)
+	var e entry
+	if err == nil {
+		e, err = b.db.newPutEntry(key, value, opts)
+	}
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return
+	}
+	b.ops = append(b.ops, e)
+}
+
+func (b *WriteBatch) Delete(key string) {
+	key, err := b.key(key)
+	if err == nil {
+		err = b.db.checkKey(key)
+	}
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return
+	}
+	b.ops = append(b.ops, entry{
+		key:  key,
+		kind: kindDelete,
+	})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Commit writes all operations of the batch as a single record. Later
+// operations on the same key win over earlier ones.
+func (b *WriteBatch) Commit() error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	size := int64(recordHeaderSize + 8)
+	for _, op := range b.ops {
+		size += int64(op.encodedSize())
+	}
+	if size > maxRecordSize {
+		return &ErrTooLarge{"batch", size, maxRecordSize}
+	}
+	b.db.condMu.RLock()
+	defer b.db.condMu.RUnlock()
+	_, err := b.db.write(func(version uint64) entry {
+		ops := make([]entry, len(b.ops))
+		for i, op := range b.ops {
+			ops[i] = op.withVersion(version)
+		}
+		return newBatchEntry(ops).withVersion(version)
+	})
+	return err
+}
+
+// A batch is stored as a record of kindBatch whose value is the
+// concatenation of the encoded operations. Every operation keeps its own
+// header, so it can be read at its offset like a standalone record.
+func newBatchEntry(ops []entry) entry {
+	var value []byte
+	for _, op := range ops {
+		value = append(value, op.Encode()...)
+	}
+	return entry{
+		value: string(value),
+		kind:  kindBatch,
+		ops:   ops,
+	}
+}
+
+// decodeBatch decodes the operations stored in the value of a batch
+// record.
+func decodeBatch(value string) ([]entry, error) {
+	var ops []entry
+	data := []byte(value)
+	for pos := 0; pos < len(data); {
+		if pos+4 > len(data) {
+			return nil, errMalformed
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos:]))
+		if size <= 0 || pos+size > len(data) {
+			return nil, errMalformed
+		}
+		var op entry
+		err := op.Decode(data[pos : pos+size])
+		if err != nil {
+			return nil, err
+		}
+		if op.kind == kindBatch {
+			return nil, errMalformed
+		}
+		ops = append(ops, op)
+		pos += size
+	}
+	return ops, nil
+}
@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWriteBatch_Commit(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-batch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("deleted", "value"); err != nil {
+		t.Fatal(err)
+	}
+	batch := db.NewBatch()
+	for _, pair := range pairs {
+		batch.Put(pair[0], "old")
+		batch.Put(pair[0], pair[1])
+	}
+	batch.Delete("deleted")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		for _, pair := range pairs {
+			value, err := db.Get(pair[0])
+			if err != nil || value != pair[1] {
+				t.Errorf("Bad value of %s: %s, %v", pair[0], value, err)
+			}
+		}
+		if _, err := db.Get("deleted"); err != ErrNotFound {
+			t.Errorf("Expected deleted key to be not found, got %v", err)
+		}
+	}
+	check(db)
+
+	t.Run("new db process", func(t *testing.T) {
+		db.Close()
+		// Without hints the batch is indexed from its record.
+		for _, sgm := range db.segments {
+			os.Remove(hintPath(sgm.path))
+		}
+		db, err = NewDb(dir, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+	})
+}
+
+func TestWriteBatch_TornBatch(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-batch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	sgm := db.segments[len(db.segments)-1]
+
+	// Write the first half of a batch as if the process died mid write.
+	record := newBatchEntry([]entry{
+		{key: "key", value: "batched", kind: kindPut},
+		{key: "other", value: "batched", kind: kindPut},
+	})
+	data := record.Encode()
+	f, err := os.OpenFile(sgm.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(data[:len(data)*2/3])
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Partially written batch was applied: %s, %v", value, err)
+	}
+	if _, err := db.Get("other"); err != ErrNotFound {
+		t.Errorf("Partially written batch was applied: %v", err)
+	}
+}
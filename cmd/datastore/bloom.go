@@ -0,0 +1,168 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+)
+
+// Bloom filters of sealed segments let lookups of missing keys skip them.
+// A filter is saved next to its segment laid out as
+//
+//	magic | hash count | segment size | bit words... | crc
+//
+// where the trailing CRC32 covers everything before it. Like a hint file the
+// filter is used only while the segment keeps the recorded size.
+const (
+	bloomMagic  = "KVSB"
+	bloomSuffix = ".bloom"
+	// With 10 bits per key and 7 hash functions about 1% of missing keys
+	// pass the filter.
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+func bloomPath(segmentPath string) string {
+	return segmentPath + bloomSuffix
+}
+
+type bloomFilter struct {
+	bits   []uint64
+	hashes int
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	words := (keys*bloomBitsPerKey + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, words),
+		hashes: bloomHashes,
+	}
+}
+
+// locations derives the bits of the key from two halves of a single hash.
+func (f *bloomFilter) locations(key string, visit func(bit uint64) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32
+	n := uint64(len(f.bits)) * 64
+	for i := 0; i < f.hashes; i++ {
+		if !visit((h1 + uint64(i)*h2) % n) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.locations(key, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// mayContain reports false only for keys that were never added.
+func (f *bloomFilter) mayContain(key string) bool {
+	found := true
+	f.locations(key, func(bit uint64) bool {
+		found = f.bits[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
+
+func (f *bloomFilter) size() int64 {
+	return int64(len(f.bits)) * 8
+}
+
+func (f *bloomFilter) encode(segmentSize int64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(bloomMagic)
+	buf.WriteByte(byte(f.hashes))
+	var scratch [8]byte
+	binary.LittleEndian.PutUint64(scratch[:], uint64(segmentSize))
+	buf.Write(scratch[:])
+	for _, word := range f.bits {
+		binary.LittleEndian.PutUint64(scratch[:], word)
+		buf.Write(scratch[:])
+	}
+	binary.LittleEndian.PutUint32(scratch[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(scratch[:4])
+	return buf.Bytes()
+}
+
+func decodeBloomFilter(data []byte) (*bloomFilter, int64, error) {
+	header := len(bloomMagic) + 9
+	if len(data) < header+4 || string(data[:len(bloomMagic)]) != bloomMagic {
+		return nil, 0, errMalformed
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, 0, errChecksum
+	}
+	segmentSize := int64(binary.LittleEndian.Uint64(body[len(bloomMagic)+1:]))
+	words := body[header:]
+	if len(words) == 0 || len(words)%8 != 0 || body[len(bloomMagic)] == 0 {
+		return nil, 0, errMalformed
+	}
+	f := &bloomFilter{
+		bits:   make([]uint64, len(words)/8),
+		hashes: int(body[len(bloomMagic)]),
+	}
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(words[i*8:])
+	}
+	return f, segmentSize, nil
+}
+
+// buildBloom fills the Bloom filter of the sealed segment from its index
+// and saves it.
+func (sgm *Segment) buildBloom() error {
+	f, size := sgm.fillBloom()
+	return ioutil.WriteFile(bloomPath(sgm.path), f.encode(size), 0o600)
+}
+
+// fillBloom fills the Bloom filter of the sealed segment from its index
+// and returns it with the segment size it covers.
+func (sgm *Segment) fillBloom() (*bloomFilter, int64) {
+	sgm.mu.Lock()
+	defer sgm.mu.Unlock()
+	f := newBloomFilter(len(sgm.index))
+	for key := range sgm.index {
+		f.add(key)
+	}
+	sgm.bloom = f
+	return f, sgm.outOffset
+}
+
+// loadBloom reads the saved Bloom filter of the segment. It reports false
+// when there is no usable filter and it has to be built.
+func (sgm *Segment) loadBloom() bool {
+	data, err := ioutil.ReadFile(bloomPath(sgm.path))
+	if err != nil {
+		return false
+	}
+	f, segmentSize, err := decodeBloomFilter(data)
+	if err != nil || segmentSize != sgm.outOffset {
+		return false
+	}
+	sgm.bloom = f
+	return true
+}
+
+// checkBloom tells whether the segment may contain the key and whether a
+// Bloom filter was consulted. Segments still being written have no filter.
+func (sgm *Segment) checkBloom(key string) (mayContain, filtered bool) {
+	sgm.mu.Lock()
+	f := sgm.bloom
+	sgm.mu.Unlock()
+	if f == nil {
+		return true, false
+	}
+	return f.mayContain(key), true
+}
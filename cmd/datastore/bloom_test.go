@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const keys = 1000
+	f := newBloomFilter(keys)
+	for i := 0; i < keys; i++ {
+		f.add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < keys; i++ {
+		if !f.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("Added key%d is missing", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < keys; i++ {
+		if f.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > keys*3/100 {
+		t.Errorf("Too many false positives: %d of %d", falsePositives, keys)
+	}
+
+	decoded, size, err := decodeBloomFilter(f.encode(123))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 123 || !reflect.DeepEqual(decoded, f) {
+		t.Errorf("Bad filter decoded for segment size %d", size)
+	}
+}
+
+func TestDb_BloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-bloom-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err = NewDb(dir, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.stopCompactor()
+	for _, sgm := range db.segments[:len(db.segments)-1] {
+		if _, err := os.Stat(bloomPath(sgm.path)); err != nil {
+			t.Errorf("Bloom filter of %s was not saved: %s", sgm.path, err)
+		}
+	}
+
+	for _, pair := range pairs {
+		if value, err := db.Get(pair[0]); err != nil || value != pair[1] {
+			t.Errorf("Bad value of %s: %s, %v", pair[0], value, err)
+		}
+	}
+	if _, err := db.Get("missing"); err != ErrNotFound {
+		t.Fatalf("Expected missing key to be not found, got %v", err)
+	}
+	stats := db.Stats()
+	if stats.BloomNegatives == 0 || stats.BloomBytes == 0 {
+		t.Errorf("Bloom filters are not used: %+v", stats)
+	}
+}
@@ -0,0 +1,353 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Keys of named buckets are stored with a prefix made of a zero byte and
+// the id of the bucket:
+//
+//	0x00 | bucket id (8 bytes, big endian) | key
+//
+// Bucket 0 is the registry, whose keys are the names of the buckets. The
+// id of a bucket is the version of its registry entry, so ids are never
+// reused and a bucket created again under a dropped name starts empty.
+// Keys of dropped buckets stay in the segments until compaction drops
+// them.
+const (
+	reservedPrefix   = "\x00"
+	bucketPrefixSize = 1 + 8
+	registryID       = 0
+)
+
+// DefaultBucket is the bucket the key methods of Db work on. Its keys are
+// stored as they are, so it holds the keys written before buckets existed.
+const DefaultBucket = "default"
+
+const maxBucketNameSize = 255
+
+var (
+	ErrBucketExists   = fmt.Errorf("bucket already exists")
+	ErrBucketNotFound = fmt.Errorf("bucket does not exist")
+	// ErrReservedKey is returned for keys of the default bucket starting
+	// with a zero byte, which are kept for named buckets.
+	ErrReservedKey = fmt.Errorf("keys starting with a zero byte are reserved")
+)
+
+func checkUserKey(key string) error {
+	if strings.HasPrefix(key, reservedPrefix) {
+		return ErrReservedKey
+	}
+	return nil
+}
+
+// userKey maps a key of the default bucket to its stored key.
+func userKey(key string) (string, error) {
+	return key, checkUserKey(key)
+}
+
+func bucketPrefix(id uint64) string {
+	var prefix [bucketPrefixSize]byte
+	binary.BigEndian.PutUint64(prefix[1:], id)
+	return string(prefix[:])
+}
+
+// bucketOf returns the id of the named bucket the stored key belongs to.
+// It reports false for keys of the default bucket.
+func bucketOf(key string) (uint64, bool) {
+	if len(key) < bucketPrefixSize || !strings.HasPrefix(key, reservedPrefix) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64([]byte(key[1:bucketPrefixSize])), true
+}
+
+// loadBuckets reads the registry of buckets.
+func (db *Db) loadBuckets() error {
+	db.buckets = make(map[string]uint64)
+	db.bucketNames = make(map[uint64]string)
+	prefix := bucketPrefix(registryID)
+	it := db.scan(prefix, PrefixEnd(prefix), prefix, ScanOptions{})
+	for it.Next() {
+		db.buckets[it.Key()] = it.Version()
+		db.bucketNames[it.Version()] = it.Key()
+	}
+	return it.Err()
+}
+
+// droppedKeys returns a function telling whether a stored key belongs to
+// a bucket dropped before the call.
+func (db *Db) droppedKeys() func(key string) bool {
+	db.bucketsMu.RLock()
+	live := make(map[uint64]bool, len(db.bucketNames))
+	for id := range db.bucketNames {
+		live[id] = true
+	}
+	db.bucketsMu.RUnlock()
+	return func(key string) bool {
+		id, ok := bucketOf(key)
+		return ok && id != registryID && !live[id]
+	}
+}
+
+// CreateBucket creates an empty bucket.
+func (db *Db) CreateBucket(name string) (*Bucket, error) {
+	if name == "" || name == DefaultBucket || len(name) > maxBucketNameSize {
+		return nil, fmt.Errorf("invalid bucket name %q", name)
+	}
+	db.bucketsMu.Lock()
+	defer db.bucketsMu.Unlock()
+	if _, ok := db.buckets[name]; ok {
+		return nil, ErrBucketExists
+	}
+	id, err := db.putIfAbsent(bucketPrefix(registryID)+name, "", nil)
+	if err == ErrVersionMismatch {
+		return nil, ErrBucketExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	db.buckets[name] = id
+	db.bucketNames[id] = name
+	return &Bucket{db, name, bucketPrefix(id)}, nil
+}
+
+// Bucket returns the bucket of the name.
+func (db *Db) Bucket(name string) (*Bucket, error) {
+	if name == DefaultBucket {
+		return &Bucket{db: db, name: name}, nil
+	}
+	db.bucketsMu.RLock()
+	id, ok := db.buckets[name]
+	db.bucketsMu.RUnlock()
+	if !ok {
+		return nil, ErrBucketNotFound
+	}
+	return &Bucket{db, name, bucketPrefix(id)}, nil
+}
+
+// DropBucket removes the bucket with all its keys. The keys are gone at
+// once, the space they take is reclaimed by compaction. The drop is flushed
+// to disk before DropBucket returns, whatever the durability mode is.
+func (db *Db) DropBucket(name string) error {
+	if name == DefaultBucket {
+		return fmt.Errorf("the default bucket can't be dropped")
+	}
+	db.bucketsMu.Lock()
+	defer db.bucketsMu.Unlock()
+	id, ok := db.buckets[name]
+	if !ok {
+		return ErrBucketNotFound
+	}
+	// Until the registry entry is deleted the bucket comes back after a
+	// restart, so compaction keeps its keys till then.
+	err := db.compareAndDelete(bucketPrefix(registryID)+name, id)
+	if err != nil {
+		return err
+	}
+	// Compaction drops the keys from synced segments, so the deletion has
+	// to be on disk first, or the bucket may come back after a crash with
+	// some of its keys gone.
+	err = db.sealActive()
+	if err != nil {
+		return err
+	}
+	delete(db.buckets, name)
+	delete(db.bucketNames, id)
+	db.requestCompaction()
+	return nil
+}
+
+// Buckets returns the names of all buckets in order, the default one
+// included.
+func (db *Db) Buckets() []string {
+	db.bucketsMu.RLock()
+	names := []string{DefaultBucket}
+	for name := range db.buckets {
+		names = append(names, name)
+	}
+	db.bucketsMu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Bucket is a keyspace of a Db isolated from the other buckets. Its
+// methods work like the methods of Db with the same names. Once the bucket
+// is dropped they fail with ErrBucketNotFound.
+type Bucket struct {
+	db   *Db
+	name string
+	// Prefix of the stored keys, empty for the default bucket.
+	prefix string
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// key maps a key of the bucket to its stored key.
+func (b *Bucket) key(key string) (string, error) {
+	if b.prefix == "" {
+		return userKey(key)
+	}
+	id, _ := bucketOf(b.prefix)
+	b.db.bucketsMu.RLock()
+	_, ok := b.db.bucketNames[id]
+	b.db.bucketsMu.RUnlock()
+	if !ok {
+		return "", ErrBucketNotFound
+	}
+	return b.prefix + key, nil
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return "", err
+	}
+	e, err := b.db.getEntry(key)
+	if err != nil {
+		return "", err
+	}
+	return e.value, nil
+}
+
+func (b *Bucket) GetVersioned(key string) (string, uint64, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return "", 0, err
+	}
+	e, err := b.db.getEntry(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return e.value, e.version, nil
+}
+
+func (b *Bucket) GetItem(key string) (Item, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return Item{}, err
+	}
+	return b.db.getItem(key)
+}
+
+func (b *Bucket) GetStream(key string) (*ValueReader, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.db.getStream(key)
+}
+
+func (b *Bucket) Put(key, value string, opts ...WriteOption) error {
+	_, err := b.PutVersioned(key, value, opts...)
+	return err
+}
+
+func (b *Bucket) PutVersioned(key, value string, opts ...WriteOption) (uint64, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return b.db.putVersioned(key, value, opts)
+}
+
+func (b *Bucket) PutStream(key string, r io.Reader, opts ...WriteOption) (uint64, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return b.db.putStream(key, r, opts)
+}
+
+func (b *Bucket) CompareAndSwap(key string, expectedVersion uint64, value string, opts ...WriteOption) (uint64, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return b.db.compareAndSwap(key, expectedVersion, value, opts)
+}
+
+func (b *Bucket) CompareAndSwapStream(key string, expectedVersion uint64, r io.Reader, opts ...WriteOption) (uint64, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return b.db.compareAndSwapStream(key, expectedVersion, r, opts)
+}
+
+func (b *Bucket) PutIfAbsent(key, value string, opts ...WriteOption) (uint64, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return b.db.putIfAbsent(key, value, opts)
+}
+
+func (b *Bucket) PutIfAbsentStream(key string, r io.Reader, opts ...WriteOption) (uint64, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return b.db.putIfAbsentStream(key, r, opts)
+}
+
+func (b *Bucket) PutStreamIf(key string, cond Condition, r io.Reader, opts ...WriteOption) (uint64, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return b.db.putStreamIf(key, cond, r, opts)
+}
+
+func (b *Bucket) Delete(key string) error {
+	key, err := b.key(key)
+	if err != nil {
+		return err
+	}
+	return b.db.delete(key)
+}
+
+func (b *Bucket) CompareAndDelete(key string, expectedVersion uint64) error {
+	key, err := b.key(key)
+	if err != nil {
+		return err
+	}
+	return b.db.compareAndDelete(key, expectedVersion)
+}
+
+func (b *Bucket) DeleteIf(key string, cond Condition) error {
+	key, err := b.key(key)
+	if err != nil {
+		return err
+	}
+	return b.db.deleteIf(key, cond)
+}
+
+func (b *Bucket) NewBatch() *WriteBatch {
+	return &WriteBatch{db: b.db, key: b.key}
+}
+
+// Scan iterates over the keys of the bucket in range [start, end).
+func (b *Bucket) Scan(start, end string, opts ScanOptions) *Iterator {
+	if b.prefix == "" {
+		return b.db.Scan(start, end, opts)
+	}
+	if _, err := b.key(start); err != nil {
+		return &Iterator{err: err}
+	}
+	stored := PrefixEnd(b.prefix)
+	if end != "" {
+		stored = b.prefix + end
+	}
+	return b.db.scan(b.prefix+start, stored, b.prefix, opts)
+}
+
+// ScanPrefix iterates over the keys of the bucket starting with prefix.
+func (b *Bucket) ScanPrefix(prefix string, opts ScanOptions) *Iterator {
+	return b.Scan(prefix, PrefixEnd(prefix), opts)
+}
@@ -0,0 +1,222 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Buckets(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-bucket-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.stopCompactor()
+
+	users, err := db.CreateBucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := db.CreateBucket("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateBucket("users"); err != ErrBucketExists {
+		t.Errorf("Creating an existing bucket: got %v", err)
+	}
+	if _, err := db.CreateBucket(DefaultBucket); err == nil {
+		t.Errorf("The default bucket is created again")
+	}
+
+	if err := db.Put("key", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put("key", "users"); err != nil {
+		t.Fatal(err)
+	}
+	if err := orders.Put("key", "orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := orders.Put("other", "orders"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		bucket string
+		value  string
+	}{
+		{DefaultBucket, "default"},
+		{"users", "users"},
+		{"orders", "orders"},
+	} {
+		b, err := db.Bucket(tc.bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := b.Get("key"); err != nil || value != tc.value {
+			t.Errorf("Bad value in bucket %s: %q, %v", tc.bucket, value, err)
+		}
+	}
+
+	var keys []string
+	for it := orders.Scan("", "", ScanOptions{}); it.Next(); {
+		keys = append(keys, it.Key())
+	}
+	if !reflect.DeepEqual(keys, []string{"key", "other"}) {
+		t.Errorf("Bad keys of the bucket: %q", keys)
+	}
+	keys = nil
+	for it := db.Scan("", "", ScanOptions{}); it.Next(); {
+		keys = append(keys, it.Key())
+	}
+	if !reflect.DeepEqual(keys, []string{"key"}) {
+		t.Errorf("Bad keys of the default bucket: %q", keys)
+	}
+
+	if got := db.Buckets(); !reflect.DeepEqual(got, []string{"default", "orders", "users"}) {
+		t.Errorf("Bad buckets %q", got)
+	}
+
+	if err := db.DropBucket("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get("key"); err != ErrBucketNotFound {
+		t.Errorf("Reading a dropped bucket: got %v", err)
+	}
+	if err := users.Put("key", "value"); err != ErrBucketNotFound {
+		t.Errorf("Writing a dropped bucket: got %v", err)
+	}
+	if _, err := db.Bucket("users"); err != ErrBucketNotFound {
+		t.Errorf("Dropped bucket is found: %v", err)
+	}
+	if err := db.DropBucket(DefaultBucket); err == nil {
+		t.Errorf("The default bucket is dropped")
+	}
+
+	// Buckets survive a restart, dropped ones don't.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.stopCompactor()
+	if got := db.Buckets(); !reflect.DeepEqual(got, []string{"default", "orders"}) {
+		t.Errorf("Bad buckets after reopening %q", got)
+	}
+	orders, err = db.Bucket("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := orders.Get("key"); err != nil || value != "orders" {
+		t.Errorf("Bad value after reopening: %q, %v", value, err)
+	}
+
+	users, err = db.CreateBucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get("key"); err != ErrNotFound {
+		t.Errorf("Recreated bucket isn't empty: %v", err)
+	}
+}
+
+func TestDb_DropBucketCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-bucket-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.stopCompactor()
+
+	logs, err := db.CreateBucket("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := logs.Put(string(rune('a'+i%26))+string(rune('a'+i/26)), "entry"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.mu.Lock()
+	active := db.segments[len(db.segments)-1]
+	db.mu.Unlock()
+	if err := db.DropBucket("logs"); err != nil {
+		t.Fatal(err)
+	}
+	// The deletion of the registry entry is flushed before compaction
+	// may drop the keys of the bucket.
+	if active.writable() {
+		t.Error("Segment holding the dropped bucket is still written to")
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := logs.prefix
+	db.mu.Lock()
+	for _, sgm := range db.segments {
+		for key := range sgm.index {
+			if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+				t.Errorf("Key %q of the dropped bucket is left in %s", key, sgm.path)
+			}
+		}
+	}
+	db.mu.Unlock()
+	if value, err := db.Get("kept"); err != nil || value != "value" {
+		t.Errorf("Bad value after compaction: %q, %v", value, err)
+	}
+}
+
+func TestDb_ReservedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-bucket-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.CreateBucket("bucket"); err != nil {
+		t.Fatal(err)
+	}
+	registry := bucketPrefix(registryID) + "bucket"
+	if err := db.Put(registry, "value"); err != ErrReservedKey {
+		t.Errorf("Put of a reserved key: got %v", err)
+	}
+	if _, err := db.Get(registry); err != ErrReservedKey {
+		t.Errorf("Get of a reserved key: got %v", err)
+	}
+	if err := db.Delete(registry); err != ErrReservedKey {
+		t.Errorf("Delete of a reserved key: got %v", err)
+	}
+	b := db.NewBatch()
+	b.Put(registry, "value")
+	if err := b.Commit(); err != ErrReservedKey {
+		t.Errorf("Batch with a reserved key: got %v", err)
+	}
+	if it := db.ScanPrefix(reservedPrefix, ScanOptions{}); it.Next() {
+		t.Errorf("Scan returns the reserved key %q", it.Key())
+	}
+}
@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cacheEntryOverhead approximates the memory a cached entry takes on top of
+// its key and value.
+const cacheEntryOverhead = 64
+
+// WithCache keeps recently read values in memory up to the given number of
+// bytes. Zero disables the cache.
+func WithCache(budget int64) Option {
+	return func(db *Db) {
+		if budget > 0 {
+			db.cache = newValueCache(budget)
+		} else {
+			db.cache = nil
+		}
+	}
+}
+
+// valueCache is an LRU cache of the latest entries of keys. Writes
+// invalidate the keys they change, and values read from segments are only
+// cached when no write happened during the read, so a slow read can't put
+// back a value overwritten meanwhile. Compaction keeps the latest entry of
+// every key, so cached entries stay valid across it.
+type valueCache struct {
+	mu     sync.Mutex
+	budget int64
+	used   int64
+	// Front is the most recently used.
+	order *list.List
+	items map[string]*list.Element
+	// Counts invalidations, see fill.
+	writes uint64
+	hits   uint64
+	misses uint64
+}
+
+func newValueCache(budget int64) *valueCache {
+	return &valueCache{
+		budget: budget,
+		order:  list.New(),
+		items:  make(map[string]*list.Element),
+	}
+}
+
+func cachedSize(e *entry) int64 {
+	return int64(len(e.key) + len(e.value) + cacheEntryOverhead)
+}
+
+func (c *valueCache) get(key string) (entry, bool) {
+	if c == nil {
+		return entry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return entry{}, false
+	}
+	e := item.Value.(entry)
+	if e.expired(time.Now()) {
+		c.remove(item)
+		c.misses++
+		return entry{}, false
+	}
+	c.order.MoveToFront(item)
+	c.hits++
+	return e, true
+}
+
+// sequence returns the number of invalidations so far. It is taken before
+// reading an entry from segments and passed to fill.
+func (c *valueCache) sequence() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+// fill caches an entry read from segments unless a write happened since
+// the sequence was taken.
+func (c *valueCache) fill(e entry, sequence uint64) {
+	if c == nil {
+		return
+	}
+	size := cachedSize(&e)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writes != sequence || size > c.budget {
+		return
+	}
+	if item, ok := c.items[e.key]; ok {
+		c.remove(item)
+	}
+	c.items[e.key] = c.order.PushFront(e)
+	c.used += size
+	for c.used > c.budget {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *valueCache) invalidate(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	for _, key := range keys {
+		if item, ok := c.items[key]; ok {
+			c.remove(item)
+		}
+	}
+}
+
+func (c *valueCache) remove(item *list.Element) {
+	e := c.order.Remove(item).(entry)
+	delete(c.items, e.key)
+	c.used -= cachedSize(&e)
+}
+
+// stats returns the hit and miss counters and the bytes in use.
+func (c *valueCache) stats() (hits, misses uint64, used int64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.used
+}
+
+// writtenKeys returns the keys changed by writing the entry.
+func writtenKeys(e entry) []string {
+	if e.kind != kindBatch {
+		return []string{e.key}
+	}
+	keys := make([]string, len(e.ops))
+	for i, op := range e.ops {
+		keys[i] = op.key
+	}
+	return keys
+}
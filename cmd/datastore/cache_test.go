@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestValueCache_Eviction(t *testing.T) {
+	e := entry{key: "key1", value: "value"}
+	c := newValueCache(2 * cachedSize(&e))
+	for _, key := range []string{"key1", "key2", "key3"} {
+		c.fill(entry{key: key, value: "value"}, c.sequence())
+		// Keep the first key recently used.
+		c.get("key1")
+	}
+	if _, ok := c.get("key2"); ok {
+		t.Error("Least recently used key was not evicted")
+	}
+	for _, key := range []string{"key1", "key3"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("Key %s was evicted", key)
+		}
+	}
+
+	sequence := c.sequence()
+	c.invalidate("key1")
+	if _, ok := c.get("key1"); ok {
+		t.Error("Invalidated key is still cached")
+	}
+	// Read before the invalidation, so the value may be stale.
+	c.fill(entry{key: "key1", value: "stale"}, sequence)
+	if _, ok := c.get("key1"); ok {
+		t.Error("Value read before a write was cached")
+	}
+}
+
+func TestDb_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-cache-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40, WithCache(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	check := func(key, expected string) {
+		t.Helper()
+		value, err := db.Get(key)
+		if expected == "" {
+			if err != ErrNotFound {
+				t.Errorf("Expected %s to be not found, got %q, %v", key, value, err)
+			}
+			return
+		}
+		if err != nil || value != expected {
+			t.Errorf("Bad value of %s: %q, %v", key, value, err)
+		}
+	}
+
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+		check(pair[0], pair[1])
+		check(pair[0], pair[1])
+	}
+	if stats := db.Stats(); stats.CacheHits != uint64(len(pairs)) || stats.CacheBytes == 0 {
+		t.Errorf("Bad cache stats: %+v", stats)
+	}
+
+	if err := db.Put("key1", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	check("key1", "updated")
+	if err := db.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+	check("key2", "")
+	batch := db.NewBatch()
+	batch.Put("key3", "batched")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	check("key3", "batched")
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("key1", "updated")
+	check("key2", "")
+	check("key3", "batched")
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import "fmt"
+
+// ErrVersionMismatch is returned by conditional writes when the key isn't
+// in the expected state.
+var ErrVersionMismatch = fmt.Errorf("version mismatch")
+
+// Condition tells whether a conditional write goes ahead given the current
+// version of the key and whether the key exists. It is called with writes
+// of other conditions held, so it must not use the database.
+type Condition func(version uint64, found bool) bool
+
+// VersionIn is the condition of the key existing with one of the versions.
+func VersionIn(versions ...uint64) Condition {
+	return func(version uint64, found bool) bool {
+		for _, v := range versions {
+			if found && version == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Exists is the condition of the key existing with any version.
+func Exists(_ uint64, found bool) bool {
+	return found
+}
+
+func absent(_ uint64, found bool) bool {
+	return !found
+}
+
+// CompareAndSwap stores the value only if the key exists and its version
+// equals expectedVersion. It returns the new version of the key.
+func (db *Db) CompareAndSwap(key string, expectedVersion uint64, value string, opts ...WriteOption) (uint64, error) {
+	if err := checkUserKey(key); err != nil {
+		return 0, err
+	}
+	return db.compareAndSwap(key, expectedVersion, value, opts)
+}
+
+func (db *Db) compareAndSwap(key string, expectedVersion uint64, value string, opts []WriteOption) (uint64, error) {
+	e, err := db.newPutEntry(key, value, opts)
+	if err != nil {
+		return 0, err
+	}
+	return db.writeIf(e, VersionIn(expectedVersion))
+}
+
+// PutIfAbsent stores the value only if the key doesn't exist. It returns
+// the version of the new key.
+func (db *Db) PutIfAbsent(key, value string, opts ...WriteOption) (uint64, error) {
+	if err := checkUserKey(key); err != nil {
+		return 0, err
+	}
+	return db.putIfAbsent(key, value, opts)
+}
+
+func (db *Db) putIfAbsent(key, value string, opts []WriteOption) (uint64, error) {
+	e, err := db.newPutEntry(key, value, opts)
+	if err != nil {
+		return 0, err
+	}
+	return db.writeIf(e, absent)
+}
+
+// CompareAndDelete deletes the key only if its version equals
+// expectedVersion.
+func (db *Db) CompareAndDelete(key string, expectedVersion uint64) error {
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	return db.compareAndDelete(key, expectedVersion)
+}
+
+func (db *Db) compareAndDelete(key string, expectedVersion uint64) error {
+	return db.deleteIf(key, VersionIn(expectedVersion))
+}
+
+// DeleteIf deletes the key only if the condition holds.
+func (db *Db) DeleteIf(key string, cond Condition) error {
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	return db.deleteIf(key, cond)
+}
+
+func (db *Db) deleteIf(key string, cond Condition) error {
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	_, err := db.writeIf(entry{key: key, kind: kindDelete}, cond)
+	return err
+}
+
+func (db *Db) writeIf(e entry, check Condition) (uint64, error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	db.condMu.Lock()
+	defer db.condMu.Unlock()
+	current, err := db.getEntry(e.key)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	if !check(current.version, err == nil) {
+		return 0, ErrVersionMismatch
+	}
+	return db.write(e.withVersion)
+}
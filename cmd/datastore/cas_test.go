@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-cas-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	v1, err := db.PutIfAbsent("key", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutIfAbsent("key", "second"); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch for an existing key, got %v", err)
+	}
+
+	value, version, err := db.GetVersioned("key")
+	if err != nil || value != "first" || version != v1 {
+		t.Errorf("Bad versioned value: %s, %d, %v", value, version, err)
+	}
+
+	v2, err := db.CompareAndSwap("key", v1, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Errorf("Version didn't grow: %d after %d", v2, v1)
+	}
+	if _, err := db.CompareAndSwap("key", v1, "third"); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch for a stale version, got %v", err)
+	}
+	if _, err := db.CompareAndSwap("missing", 0, "value"); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch for a missing key, got %v", err)
+	}
+	if err := db.CompareAndDelete("key", v1); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch on delete, got %v", err)
+	}
+
+	t.Run("new db process", func(t *testing.T) {
+		db.Close()
+		db, err = NewDb(dir, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, version, err := db.GetVersioned("key")
+		if err != nil || value != "second" || version != v2 {
+			t.Errorf("Bad versioned value: %s, %d, %v", value, version, err)
+		}
+		v3, err := db.PutVersioned("key", "third")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v3 <= v2 {
+			t.Errorf("Version didn't grow after restart: %d after %d", v3, v2)
+		}
+		if err := db.CompareAndDelete("key", v3); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected deleted key to be not found, got %v", err)
+		}
+	})
+}
+
+func TestDb_Conditions(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-cas-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.PutStreamIf("key", Exists, strings.NewReader("value")); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch for a missing key, got %v", err)
+	}
+	if err := db.DeleteIf("key", Exists); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch on delete of a missing key, got %v", err)
+	}
+	v1, err := db.PutVersioned("key", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := db.PutStreamIf("key", Exists, strings.NewReader("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutStreamIf("key", VersionIn(v1, v2+1), strings.NewReader("third")); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch for other versions, got %v", err)
+	}
+	v3, err := db.PutStreamIf("key", VersionIn(v1, v2), strings.NewReader("third"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, version, err := db.GetVersioned("key")
+	if err != nil || value != "third" || version != v3 {
+		t.Errorf("Bad versioned value: %s, %d, %v", value, version, err)
+	}
+
+	if err := db.DeleteIf("key", VersionIn(v1, v2)); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch on delete, got %v", err)
+	}
+	if err := db.DeleteIf("key", VersionIn(v2, v3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Expected deleted key to be not found, got %v", err)
+	}
+}
+
+func TestDb_VersionsAfterCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-cas-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.stopCompactor()
+	if _, err := db.PutVersioned("key", "first"); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := db.PutVersioned("key", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	// The tombstone holding the latest version is dropped.
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	version, err := db.PutVersioned("key", "third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version <= v2+1 {
+		t.Errorf("Version %d after restart was given before the delete at %d", version, v2+1)
+	}
+	if _, err := db.CompareAndSwap("key", v2, "stale"); err != ErrVersionMismatch {
+		t.Errorf("Stale version matched after restart: %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A failed compaction is retried after a delay growing from minRetryDelay
+// up to maxRetryDelay.
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// compactor is the background worker merging old segments.
+type compactor struct {
+	requests chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// Serializes compactions, so the merged segments are never changed by
+	// anything else.
+	mu sync.Mutex
+}
+
+func (db *Db) startCompactor() {
+	db.compactor.requests = make(chan struct{}, 1)
+	db.compactor.stop = make(chan struct{})
+	db.compactor.done = make(chan struct{})
+	go db.runCompactor()
+}
+
+// requestCompaction wakes the compactor up without waiting for it.
+func (db *Db) requestCompaction() {
+	select {
+	case db.compactor.requests <- struct{}{}:
+	default:
+	}
+}
+
+// stopCompactor waits for a running compaction to finish and stops the
+// worker.
+func (db *Db) stopCompactor() {
+	if db.compactor.stop == nil {
+		return
+	}
+	db.compactor.stopOnce.Do(func() {
+		close(db.compactor.stop)
+	})
+	<-db.compactor.done
+}
+
+func (db *Db) runCompactor() {
+	defer close(db.compactor.done)
+	delay := minRetryDelay
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-db.compactor.stop:
+			return
+		case <-db.compactor.requests:
+		case <-retry:
+		}
+		retry = nil
+		err := db.compact()
+		if err != nil {
+			log.Printf("Compaction failed, retrying in %s: %s", delay, err)
+			retry = time.After(delay)
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+		delay = minRetryDelay
+	}
+}
+
+// compact merges the sealed segments picked by the compaction policy.
+func (db *Db) compact() error {
+	return db.compactWith(db.policy.Pick)
+}
+
+// Compact seals the active segment and merges all segments into one,
+// whatever the compaction policy is.
+func (db *Db) Compact() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.condMu.RLock()
+	closed := db.closed
+	db.condMu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+	err := db.sealActive()
+	if err != nil {
+		return err
+	}
+	return db.compactWith(func(segments []SegmentInfo) (int, int) {
+		return 0, len(segments)
+	})
+}
+
+// compactWith merges the range of sealed segments returned by pick. The
+// segments are read from a snapshot of the segment list without holding
+// db.mu, so reads and writes go on meanwhile, and the merged segment is
+// published with a single swap of the list.
+func (db *Db) compactWith(pick func([]SegmentInfo) (int, int)) error {
+	db.compactor.mu.Lock()
+	defer db.compactor.mu.Unlock()
+
+	db.mu.Lock()
+	// Only compaction replaces segments, new ones are appended after the
+	// snapshot, so it stays the head of the list until the swap.
+	snapshot := db.segments[:len(db.segments):len(db.segments)]
+	db.mu.Unlock()
+	sealed := snapshot
+	if snapshot[len(snapshot)-1].writable() {
+		sealed = snapshot[:len(snapshot)-1]
+	}
+	infos := segmentInfos(snapshot, db.droppedKeys())
+	start, end := pick(infos[:len(sealed)])
+	if start >= end {
+		return nil
+	}
+	merging := sealed[start:end]
+	// Segments followed by a newer one are sealed or about to be.
+	for _, sgm := range merging {
+		sgm.StopWritingThread()
+	}
+
+	// Segments older than the merged ones may still hold keys deleted or
+	// expired in them.
+	merged, err := db.merge(merging, start == 0)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	segments := append([]*Segment{}, db.segments[:start]...)
+	segments = append(segments, merged)
+	segments = append(segments, db.segments[end:]...)
+	err = writeManifest(db.dirPath, segments, db.latestVersion())
+	if err == nil {
+		db.segments = segments
+	}
+	db.mu.Unlock()
+	if err != nil {
+		merged.HardRemove()
+		return err
+	}
+
+	// The merged segments are gone from the manifest, so the ones that
+	// can't be removed now are cleaned up on the next start.
+	for _, old := range merging {
+		err := old.HardRemove()
+		if err != nil {
+			log.Printf("Cannot remove merged segment %s: %s", old.path, err)
+		}
+	}
+	return nil
+}
+
+// segmentInfos describes the segments for a compaction policy. A record is
+// live when no newer segment holds its key and its bucket isn't dropped.
+func segmentInfos(segments []*Segment, dropped func(key string) bool) []SegmentInfo {
+	infos := make([]SegmentInfo, len(segments))
+	seen := make(map[string]bool)
+	for i := len(segments) - 1; i >= 0; i-- {
+		sgm := segments[i]
+		sgm.mu.Lock()
+		infos[i].Size = sgm.outOffset
+		for key, pos := range sgm.index {
+			if !seen[key] {
+				seen[key] = true
+				if dropped(key) {
+					continue
+				}
+				infos[i].LiveBytes += int64(pos.size)
+			}
+		}
+		sgm.mu.Unlock()
+	}
+	return infos
+}
+
+// mergedRecord is the latest record of a key in the merged segments.
+type mergedRecord struct {
+	sgm  *Segment
+	file *os.File
+	pos  recordPos
+}
+
+// merge writes the latest records of the segments into a new sealed one.
+// Tombstones and expired entries are dropped when dropDeleted is set, keys
+// of dropped buckets always. Records are copied from file to file, so only
+// the values that are re-encrypted are read into memory.
+func (db *Db) merge(segments []*Segment, dropDeleted bool) (*Segment, error) {
+	latest := make(map[string]mergedRecord)
+	for _, sgm := range segments {
+		sgm.mu.Lock()
+		file, err := sgm.acquire()
+		if err == nil {
+			for key, pos := range sgm.index {
+				latest[key] = mergedRecord{sgm, file, pos}
+			}
+		}
+		sgm.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		defer sgm.release()
+	}
+
+	// The merged segment isn't live until the manifest lists it, so after a
+	// crash it is removed as a leftover.
+	sgm, err := NewSegment(db.nextSegmentPath(), db.segmentSize, false, Durability{})
+	if err != nil {
+		return nil, err
+	}
+	sgm.keyring = db.keyring
+	output, err := os.OpenFile(sgm.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err == nil {
+		err = db.copyLatest(sgm, output, latest, dropDeleted)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		sgm.HardRemove()
+		return nil, err
+	}
+	sgm.writeIndexFiles()
+	return sgm, nil
+}
+
+// copyLatest appends the live records to the merged segment and indexes
+// them. Records are copied as they are, but values of rotated keys are
+// moved under the active one.
+func (db *Db) copyLatest(sgm *Segment, output *os.File, latest map[string]mergedRecord, dropDeleted bool) error {
+	now := time.Now()
+	dropped := db.droppedKeys()
+	out := bufio.NewWriterSize(output, bufSize)
+	for key, rec := range latest {
+		if dropped(key) {
+			continue
+		}
+		e, start, err := readRecordHead(rec.file, rec.pos)
+		if err != nil {
+			if isCorruption(err) {
+				return &ErrCorrupted{rec.sgm.path, rec.pos.offset, err}
+			}
+			return err
+		}
+		if dropDeleted && (e.kind == kindDelete || e.expired(now)) {
+			continue
+		}
+		size := int64(rec.pos.size)
+		var record io.Reader = io.NewSectionReader(rec.file, rec.pos.offset, size)
+		if db.keyring.rotated(e) {
+			value := make([]byte, size-int64(start))
+			_, err = rec.file.ReadAt(value, rec.pos.offset+int64(start))
+			if err == nil {
+				e.value = string(value)
+				e, err = db.keyring.reencrypt(e)
+			}
+			if err != nil {
+				return err
+			}
+			data := e.Encode()
+			record, size = bytes.NewReader(data), int64(len(data))
+		}
+		_, err = io.Copy(out, record)
+		if err != nil {
+			return err
+		}
+		sgm.indexEntry(e, recordPos{sgm.outOffset, uint32(size)})
+		sgm.outOffset += size
+	}
+	err := out.Flush()
+	if err != nil {
+		return err
+	}
+	return output.Sync()
+}
@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_Compactor(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-compaction-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		// Reads never wait for a running compaction.
+		if _, err := db.Get("key0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mu.Lock()
+		n := len(db.segments)
+		db.mu.Unlock()
+		if n <= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Segments were not compacted: %d left", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 45; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i%5)
+		if value, err := db.Get(key); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Bad value of %s: %s, %v", key, value, err)
+		}
+	}
+}
+
+func TestDb_CompactionFailure(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-compaction-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.stopCompactor()
+
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := db.segments
+
+	// A segment that can't be read fails the compaction.
+	path := segments[0].path
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.compact(); err == nil {
+		t.Fatal("Expected compaction to fail")
+	}
+	if len(db.segments) != len(segments) {
+		t.Fatalf("Segment list changed by a failed compaction")
+	}
+
+	// Nothing is left over to keep the next attempt from running.
+	if err := os.Rename(path+".moved", path); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.segments) != 2 {
+		t.Errorf("Expected merged and newest segments, got %d", len(db.segments))
+	}
+	for _, pair := range pairs {
+		if value, err := db.Get(pair[0]); err != nil || value != pair[1] {
+			t.Errorf("Bad value of %s: %s, %v", pair[0], value, err)
+		}
+	}
+}
+
+func TestDb_CompactRange(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-compaction-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.stopCompactor()
+
+	if err := db.Put("key", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tombstone shadows the value in an older segment, so it is kept
+	// when the oldest segment isn't merged.
+	err = db.compactWith(func(segments []SegmentInfo) (int, int) {
+		return 1, len(segments)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Expected deleted key to be not found, got %v", err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.segments) != 1 {
+		t.Fatalf("Expected a single segment after a forced compaction, got %d", len(db.segments))
+	}
+	if _, ok := db.segments[0].index["key"]; ok {
+		t.Error("Tombstone was not dropped during a full compaction")
+	}
+	if value, err := db.Get("other"); err != nil || value != "value" {
+		t.Errorf("Bad value of other key: %s, %v", value, err)
+	}
+	if err := db.Put("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "new" {
+		t.Errorf("Bad value after compaction: %s, %v", value, err)
+	}
+}
@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Codec compresses entry values. The codec of an entry is recorded in its
+// record, so segments may mix entries of different codecs.
+type Codec byte
+
+const (
+	// NoCompression stores values as they are.
+	NoCompression Codec = iota
+	// Flate compresses values with DEFLATE.
+	Flate
+)
+
+func (c Codec) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Flate:
+		return "flate"
+	}
+	return fmt.Sprintf("Codec(%d)", int(c))
+}
+
+// ParseCodec converts the name of a codec back to Codec.
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range []Codec{NoCompression, Flate} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return NoCompression, fmt.Errorf("unknown codec %q", name)
+}
+
+func (c Codec) compress(value string) (string, error) {
+	var buf bytes.Buffer
+	w, err := c.compressor(&buf)
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write([]byte(value))
+	if err == nil {
+		err = w.Close()
+	}
+	return buf.String(), err
+}
+
+func (c Codec) decompress(value string) (string, error) {
+	r, err := c.decompressor(strings.NewReader(value))
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", errMalformed
+	}
+	return string(data), nil
+}
+
+// compressor returns a writer compressing what is written to it into w.
+// It has to be closed to flush the compressed data.
+func (c Codec) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case Flate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return nil, errMalformed
+}
+
+// decompressor returns a reader of the data r holds compressed.
+func (c Codec) decompressor(r io.Reader) (io.Reader, error) {
+	switch c {
+	case NoCompression:
+		return r, nil
+	case Flate:
+		return flate.NewReader(r), nil
+	}
+	return nil, errMalformed
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Compression chooses the codec of written values.
+type Compression struct {
+	Codec Codec
+	// Values shorter than Threshold bytes are stored uncompressed.
+	Threshold int
+}
+
+// WithCompression compresses written values with the codec. Values that
+// don't get smaller are stored uncompressed. Entries written before keep
+// their codec until they are overwritten.
+func WithCompression(c Compression) Option {
+	return func(db *Db) {
+		db.compression = c
+	}
+}
+
+// compress replaces the value of the entry with its compressed form when
+// that saves space.
+func (c Compression) compress(e entry) entry {
+	if c.Codec == NoCompression || e.kind != kindPut || len(e.value) < c.Threshold {
+		return e
+	}
+	compressed, err := c.Codec.compress(e.value)
+	if err != nil || len(compressed) >= len(e.value) {
+		return e
+	}
+	e.value = compressed
+	e.codec = c.Codec
+	return e
+}
+
+// openValue restores the value of a stored entry: decrypts it with the
+// keyring and decompresses it.
+func openValue(e entry, k *Keyring) (entry, error) {
+	e, err := k.decrypt(e)
+	if err != nil {
+		return entry{}, err
+	}
+	return e.decompressed()
+}
+
+// decompressed returns the entry with its value restored.
+func (e entry) decompressed() (entry, error) {
+	value, err := e.codec.decompress(e.value)
+	if err != nil {
+		return entry{}, err
+	}
+	e.value = value
+	e.codec = NoCompression
+	return e, nil
+}
@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompression_Entry(t *testing.T) {
+	value := strings.Repeat(`{"name":"redstone","team":"lab"}`, 20)
+	c := Compression{Codec: Flate, Threshold: 100}
+
+	short := c.compress(entry{key: "key", value: "short", kind: kindPut})
+	if short.codec != NoCompression {
+		t.Errorf("Value below the threshold was compressed")
+	}
+
+	e := c.compress(entry{key: "key", value: value, kind: kindPut})
+	if e.codec != Flate || len(e.value) >= len(value) {
+		t.Fatalf("Value was not compressed: codec %s, %d bytes", e.codec, len(e.value))
+	}
+	var decoded entry
+	if err := decoded.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, e) {
+		t.Errorf("Bad entry decoded: %+v", decoded)
+	}
+	got, err := readValue(bufio.NewReader(bytes.NewReader(e.Encode())))
+	if err != nil || got != value {
+		t.Errorf("Bad value read: %q, %v", got, err)
+	}
+}
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-compression-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	value := strings.Repeat(`{"name":"redstone","team":"lab"}`, 20)
+	// Written before compression is turned on.
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", value); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, segmentSize, WithCompression(Compression{Codec: Flate, Threshold: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("compressed", value); err != nil {
+		t.Fatal(err)
+	}
+	batch := db.NewBatch()
+	batch.Put("batched", value)
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for _, key := range []string{"plain", "compressed", "batched"} {
+			if got, err := db.Get(key); err != nil || got != value {
+				t.Errorf("Bad value of %s: %q, %v", key, got, err)
+			}
+		}
+	}
+	check()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	e, _, err := db.segments[0].getStored("compressed")
+	if err != nil || e.codec != Flate {
+		t.Errorf("Compaction didn't keep the value compressed: %s, %v", e.codec, err)
+	}
+}
@@ -5,99 +5,364 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// legacyMergeName is the temporary file compaction used to write before
+// the manifest existed.
+const legacyMergeName = "system-segment"
+
 type InsertQuery struct {
 	data   entry
 	result chan error
 }
 
 type Db struct {
+	// Updated atomically, kept first to be 64-bit aligned.
+	bloomNegatives      uint64
+	bloomFalsePositives uint64
+
 	segments    []*Segment
 	segmentSize int64
 	dirPath     string
-	combining   bool
+	strict      bool
+	durability  Durability
+	compression Compression
+	keyring     *Keyring
+	limits      Limits
+	readOnly    bool
 	mu          sync.Mutex
+	rollMu      sync.Mutex
+
+	// The latest version given to a written entry.
+	version   uint64
+	versionMu sync.Mutex
+	// Held exclusively by conditional writes, so nothing is written
+	// between checking the version of a key and writing it.
+	condMu sync.RWMutex
+	// Set by Close, guarded by condMu.
+	closed bool
+
+	policy    CompactionPolicy
+	compactor compactor
+	// Nil when caching is disabled.
+	cache *valueCache
+
+	// Ids of the named buckets by name and the other way round.
+	buckets     map[string]uint64
+	bucketNames map[uint64]string
+	bucketsMu   sync.RWMutex
+
+	changeRetention int
+	feed            *changeFeed
+	// The locked LOCK file of the directory, nil once the Db is closed.
+	lock *os.File
+}
+
+// Option configures optional Db behaviour.
+type Option func(db *Db)
+
+// WithStrictRecovery makes NewDb fail when a segment ends with a partially
+// written record instead of truncating it.
+func WithStrictRecovery(strict bool) Option {
+	return func(db *Db) {
+		db.strict = strict
+	}
+}
+
+// WithReadOnly opens the database for reading only. Several read-only Db
+// may share a directory, but not with a writable one. Recovery leaves the
+// files as they are and writes fail with ErrReadOnly.
+func WithReadOnly(readOnly bool) Option {
+	return func(db *Db) {
+		db.readOnly = readOnly
+	}
+}
+
+// WriteOption configures a single put.
+type WriteOption func(e *entry)
+
+// WithTTL makes the key expire after ttl. Expired keys are reported as not
+// found and dropped by compaction.
+func WithTTL(ttl time.Duration) WriteOption {
+	return func(e *entry) {
+		e.expiresAt = time.Now().Add(ttl).UnixNano()
+	}
+}
+
+func (db *Db) newPutEntry(key, value string, opts []WriteOption) (entry, error) {
+	if err := db.checkKey(key); err != nil {
+		return entry{}, err
+	}
+	if err := db.checkValue(int64(len(value))); err != nil {
+		return entry{}, err
+	}
+	e := entry{
+		key:   key,
+		value: value,
+		kind:  kindPut,
+	}
+	for _, opt := range opts {
+		opt(&e)
+	}
+	if len(e.contentType) > maxContentTypeSize {
+		return entry{}, fmt.Errorf("content type is longer than %d bytes", maxContentTypeSize)
+	}
+	return db.keyring.encrypt(db.compression.compress(e))
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
 	db := &Db{
 		segments:    []*Segment{},
 		segmentSize: segmentSize,
 		dirPath:     dir,
-		combining:   false,
+		policy:      SegmentCountPolicy{MinSegments: 2},
 	}
-	err := db.recover()
-	if err != nil && err != io.EOF {
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.durability.Mode == SyncInterval && db.durability.Interval <= 0 {
+		return nil, fmt.Errorf("sync interval must be positive")
+	}
+	limits, err := db.limits.withDefaults()
+	if err != nil {
 		return nil, err
 	}
-	_, err = db.newSegment()
+	db.limits = limits
+	lock, err := lockDir(dir, db.readOnly)
 	if err != nil {
 		return nil, err
 	}
+	db.lock = lock
+	err = db.open()
+	if err != nil {
+		db.closeSegments()
+		unlockDir(lock)
+		return nil, err
+	}
 	return db, nil
 }
 
+func (db *Db) open() error {
+	err := db.recover()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	// Compaction drops the keys of unknown buckets, so they are loaded
+	// before it starts.
+	if err := db.loadBuckets(); err != nil {
+		return err
+	}
+	db.feed = newChangeFeed(db.changeRetention, db.version)
+	if db.readOnly {
+		return nil
+	}
+	_, err = db.newSegment()
+	if err != nil {
+		return err
+	}
+	db.startCompactor()
+	return nil
+}
+
 func (db *Db) newSegment() (*Segment, error) {
-	name := time.Now().UnixNano()
-	segmentPath := filepath.Join(db.dirPath, strconv.FormatInt(name, 10))
-	sgm, err := NewSegment(segmentPath, db.segmentSize, true)
+	sgm, err := NewSegment(db.nextSegmentPath(), db.segmentSize, true, db.durability)
 	if err != nil {
 		return nil, err
 	}
+	sgm.keyring = db.keyring
 	db.mu.Lock()
-	db.segments = append(db.segments, sgm)
+	segments := append(db.segments, sgm)
+	// Nothing is written to the segment before the manifest lists it.
+	err = writeManifest(db.dirPath, segments, db.latestVersion())
+	if err == nil {
+		db.segments = segments
+	}
 	db.mu.Unlock()
-	if len(db.segments) >= 3 {
-		go db.combine(len(db.segments) - 1)
+	if err != nil {
+		sgm.StopWritingThread()
+		sgm.HardRemove()
+		return nil, err
 	}
-	return sgm, err
+	if len(segments) > 1 {
+		db.requestCompaction()
+	}
+	return sgm, nil
 }
 
+// latestVersion returns the latest version given to an entry.
+func (db *Db) latestVersion() uint64 {
+	db.versionMu.Lock()
+	defer db.versionMu.Unlock()
+	return db.version
+}
+
+// nextSegmentPath returns the path for a new segment file. Segments are
+// named by their creation time.
+func (db *Db) nextSegmentPath() string {
+	name := time.Now().UnixNano()
+	for {
+		path := filepath.Join(db.dirPath, strconv.FormatInt(name, 10))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		name++
+	}
+}
+
+// recover opens the segments listed in the manifest and removes every other
+// file left by an interrupted compaction or segment upgrade. Directories
+// written before the manifest existed are recovered from the segment file
+// names.
 func (db *Db) recover() error {
-	files, err := ioutil.ReadDir(db.dirPath)
+	m, ok, err := readManifest(db.dirPath)
 	if err != nil {
 		return err
 	}
+	names := m.segments
+	db.version = m.version
+	if !ok {
+		names, err = db.legacySegments()
+		if err != nil {
+			return err
+		}
+	}
+	if !db.readOnly {
+		err = db.removeLeftovers(names, ok)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		path := filepath.Join(db.dirPath, name)
+		// NewSegment would create a missing file and lose its keys silently.
+		_, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("segment %s listed in the manifest: %w", name, err)
+		}
+		sgm, err := NewSegment(path, db.segmentSize, false, db.durability)
+		if err != nil {
+			return err
+		}
+		sgm.keyring = db.keyring
+		sgm.readOnly = db.readOnly
+		err = sgm.recover(db.strict)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if sgm.maxVersion > db.version {
+			db.version = sgm.maxVersion
+		}
+		db.segments = append(db.segments, sgm)
+	}
+	return nil
+}
+
+// legacySegments returns the segments of a directory without a manifest
+// ordered by their names, which are creation times.
+func (db *Db) legacySegments() ([]string, error) {
+	files, err := ioutil.ReadDir(db.dirPath)
+	if err != nil {
+		return nil, err
+	}
 	var segments []string
+	times := make(map[string]int64)
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
+		t, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
 		segments = append(segments, file.Name())
+		times[file.Name()] = t
 	}
 	sort.SliceStable(segments, func(i, j int) bool {
-		iTime, err := strconv.Atoi(segments[i])
-		if err != nil {
-			log.Fatal(err)
+		return times[segments[i]] < times[segments[j]]
+	})
+	return segments, nil
+}
+
+// removeLeftovers deletes the files of the directory that don't belong to
+// the live segments. Only files the database creates are removed: stale
+// segments, their hints and Bloom filters and temporary files. Without a
+// manifest segments aren't removed either. Anything else is kept.
+func (db *Db) removeLeftovers(live []string, trusted bool) error {
+	keep := map[string]bool{manifestName: true, lockName: true}
+	for _, name := range live {
+		keep[name] = true
+		keep[name+hintSuffix] = true
+		keep[name+bloomSuffix] = true
+	}
+	files, err := ioutil.ReadDir(db.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || keep[name] {
+			continue
 		}
-		jTime, err := strconv.Atoi(segments[j])
-		if err != nil {
-			log.Fatal(err)
+		temporary := name == legacyMergeName || name == manifestTmpName ||
+			strings.HasSuffix(name, upgradeSuffix) || strings.HasSuffix(name, hintSuffix) ||
+			strings.HasSuffix(name, bloomSuffix) || strings.HasSuffix(name, spoolSuffix)
+		// Segments are named by their creation time. Files of any other
+		// name aren't ours, like a key file an operator keeps here.
+		_, numeric := strconv.ParseInt(name, 10, 64)
+		if !temporary && (!trusted || numeric != nil) {
+			log.Printf("Ignoring unexpected file %s in the database directory", name)
+			continue
 		}
-		return time.Unix(0, int64(iTime)).Before(time.Unix(0, int64(jTime)))
-	})
-	for _, name := range segments {
-		path := filepath.Join(db.dirPath, name)
-		sgm, err := NewSegment(path, db.segmentSize, false)
+		err := os.Remove(filepath.Join(db.dirPath, name))
 		if err != nil {
 			return err
 		}
-		err = sgm.recover()
-		if err != nil && err != io.EOF {
-			return err
+		log.Printf("Removed leftover file %s", name)
+	}
+	return nil
+}
+
+func (db *Db) Close() error {
+	// Writes hold condMu, so none is in flight once it is taken and the
+	// later ones fail.
+	db.condMu.Lock()
+	closed := db.closed
+	db.closed = true
+	db.condMu.Unlock()
+	if closed {
+		return nil
+	}
+	db.feed.close()
+	db.stopCompactor()
+	// Sealing the active segment flushes it and writes its hint file and
+	// Bloom filter.
+	db.mu.Lock()
+	segments := db.segments
+	db.mu.Unlock()
+	if len(segments) > 0 {
+		segments[len(segments)-1].StopWritingThread()
+	}
+	err := db.closeSegments()
+	// The directory is unlocked last, once nothing here uses its files.
+	if db.lock != nil {
+		unlockErr := unlockDir(db.lock)
+		db.lock = nil
+		if err == nil {
+			err = unlockErr
 		}
-		db.segments = append(db.segments, sgm)
 	}
 	return err
 }
 
-func (db *Db) Close() error {
+func (db *Db) closeSegments() error {
 	for _, sgm := range db.segments {
 		err := sgm.Close()
 		if err != nil {
@@ -108,115 +373,191 @@ func (db *Db) Close() error {
 }
 
 func (db *Db) Get(key string) (string, error) {
+	e, err := db.getUserEntry(key)
+	if err != nil {
+		return "", err
+	}
+	return e.value, nil
+}
+
+// GetVersioned returns the value of the key together with its version.
+func (db *Db) GetVersioned(key string) (string, uint64, error) {
+	e, err := db.getUserEntry(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return e.value, e.version, nil
+}
+
+// getUserEntry is getEntry for keys of the default bucket.
+func (db *Db) getUserEntry(key string) (entry, error) {
+	if err := checkUserKey(key); err != nil {
+		return entry{}, err
+	}
+	return db.getEntry(key)
+}
+
+func (db *Db) getEntry(key string) (entry, error) {
+	if e, ok := db.cache.get(key); ok {
+		return e, nil
+	}
+	sequence := db.cache.sequence()
+	e, err := db.lookupWith(key, (*Segment).getEntry)
+	if err == nil {
+		db.cache.fill(e, sequence)
+	}
+	return e, err
+}
+
+// lookupWith looks the key up in the segments from the newest to the
+// oldest, reading it from a segment with get.
+func (db *Db) lookupWith(key string, get func(sgm *Segment, key string) (entry, error)) (entry, error) {
+	for {
+		e, err := db.lookupSegments(key, get)
+		// A compaction removed the segment meanwhile, the merged one holds
+		// the key now.
+		if err != errSegmentRemoved {
+			return e, err
+		}
+	}
+}
+
+func (db *Db) lookupSegments(key string, get func(sgm *Segment, key string) (entry, error)) (entry, error) {
 	db.mu.Lock()
 	sgms := db.segments
 	db.mu.Unlock()
 	for i := len(sgms) - 1; i >= 0; i-- {
 		sgm := sgms[i]
-		val, err := sgm.Get(key)
-		if err == nil {
-			if val == "null" {
-				break
-			}
-			return val, nil
+		mayContain, filtered := sgm.checkBloom(key)
+		if !mayContain {
+			atomic.AddUint64(&db.bloomNegatives, 1)
+			continue
 		}
+		e, err := get(sgm, key)
 		if err == ErrNotFound {
+			if filtered {
+				atomic.AddUint64(&db.bloomFalsePositives, 1)
+			}
 			continue
 		}
+		if err != nil {
+			return entry{}, err
+		}
+		if e.kind == kindDelete || e.expired(time.Now()) {
+			break
+		}
+		return e, nil
 	}
-	return "", ErrNotFound
+	return entry{}, ErrNotFound
 }
 
-func (db *Db) Put(key, value string) error {
-	e := entry{
-		key:   key,
-		value: value,
-	}
-	db.mu.Lock()
-	currentSegment := db.segments[len(db.segments)-1]
-	db.mu.Unlock()
-	if !currentSegment.active {
-		currentSegment.StopWritingThread()
-		sgm, err := db.newSegment()
-		if err != nil {
-			return err
-		}
-		currentSegment = sgm
+func (db *Db) Put(key, value string, opts ...WriteOption) error {
+	_, err := db.PutVersioned(key, value, opts...)
+	return err
+}
+
+// PutVersioned stores the value and returns the new version of the key.
+func (db *Db) PutVersioned(key, value string, opts ...WriteOption) (uint64, error) {
+	if err := checkUserKey(key); err != nil {
+		return 0, err
 	}
-	res := make(chan error)
-	err := currentSegment.Write(InsertQuery{
-		data:   e,
-		result: res,
-	})
+	return db.putVersioned(key, value, opts)
+}
+
+func (db *Db) putVersioned(key, value string, opts []WriteOption) (uint64, error) {
+	e, err := db.newPutEntry(key, value, opts)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return <-res
+	db.condMu.RLock()
+	defer db.condMu.RUnlock()
+	return db.write(e.withVersion)
 }
 
 func (db *Db) Delete(key string) error {
-	err := db.Put(key, "null")
-	return err
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	return db.delete(key)
 }
 
-func (db *Db) combine(n int) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if db.combining {
-		return nil
+func (db *Db) delete(key string) error {
+	if err := db.checkKey(key); err != nil {
+		return err
 	}
-	db.combining = true
-	forUpdate := db.segments[0:n]
-	data := make(map[string]string)
-	for _, sgm := range forUpdate {
-		all, err := sgm.GetAll()
-		if err != nil {
-			return err
-		}
-		for key, val := range all {
-			data[key] = val
-		}
+	db.condMu.RLock()
+	defer db.condMu.RUnlock()
+	_, err := db.write(entry{
+		key:  key,
+		kind: kindDelete,
+	}.withVersion)
+	return err
+}
+
+// write appends the entry built for the next version to the active
+// segment and returns that version. Versions are assigned in the order
+// entries are queued, so they grow along the log. The caller holds condMu.
+func (db *Db) write(build func(version uint64) entry) (uint64, error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
 	}
-	systemSegmentPath := filepath.Join(db.dirPath, "system-segment")
-	sgm, err := NewSegment(systemSegmentPath, db.segmentSize, true)
-	if err != nil {
-		return err
+	if db.closed {
+		return 0, ErrClosed
 	}
-	db.mu.Unlock()
-	for key, val := range data {
-		if val == "null" {
-			continue
-		}
-		e := entry{
-			key:   key,
-			value: val,
+	for {
+		currentSegment, err := db.activeSegment()
+		if err != nil {
+			return 0, err
 		}
 		res := make(chan error)
-		sgm.Write(InsertQuery{
+		db.versionMu.Lock()
+		db.version++
+		e := build(db.version)
+		err = currentSegment.Write(InsertQuery{
 			data:   e,
 			result: res,
 		})
-		err := <-res
-		if err != nil {
-			return err
+		db.versionMu.Unlock()
+		if err == nil {
+			err = <-res
 		}
+		// A failed write may still have reached the file, so its keys are
+		// dropped from the cache anyway, but only acknowledged writes are
+		// published.
+		if err == nil {
+			db.feed.resolve(e.version, changesOf(e))
+		} else {
+			db.feed.resolve(e.version, nil)
+		}
+		if err != errSegmentFull {
+			if db.cache != nil {
+				db.cache.invalidate(writtenKeys(e)...)
+			}
+			return e.version, err
+		}
+		currentSegment.StopWritingThread()
 	}
-	sgm.StopWritingThread()
+}
+
+// sealActive seals the active segment, which flushes it to disk. Writes in
+// flight get errSegmentFull and go to a new segment.
+func (db *Db) sealActive() error {
 	db.mu.Lock()
-	err = sgm.Relocate(forUpdate[len(forUpdate)-1].path)
-	if err != nil {
-		return err
-	}
-	segments := append([]*Segment{sgm}, db.segments[n:]...)
-	db.segments = segments
-	for i := 0; i < len(forUpdate)-1; i++ {
-		sgm := forUpdate[i]
-		err := sgm.HardRemove()
-		sgm = nil
-		if err != nil {
-			return fmt.Errorf("remove segment error")
-		}
+	active := db.segments[len(db.segments)-1]
+	db.mu.Unlock()
+	return active.StopWritingThread()
+}
+
+// activeSegment returns the segment new entries are appended to, starting
+// a new one once the current segment stops accepting writes.
+func (db *Db) activeSegment() (*Segment, error) {
+	db.rollMu.Lock()
+	defer db.rollMu.Unlock()
+	db.mu.Lock()
+	currentSegment := db.segments[len(db.segments)-1]
+	db.mu.Unlock()
+	if currentSegment.writable() {
+		return currentSegment, nil
 	}
-	db.combining = false
-	return nil
+	return db.newSegment()
 }
@@ -1,9 +1,11 @@
 package datastore
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 const segmentSize = 10240
@@ -108,3 +110,224 @@ func TestDb_Delete(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_NullValue(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "null"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.Get("key")
+	if err != nil {
+		t.Fatalf("Cannot get a key holding \"null\": %s", err)
+	}
+	if value != "null" {
+		t.Errorf("Bad value returned expected null, got %s", value)
+	}
+}
+
+func TestDb_DeleteAcrossSegments(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Compaction is started by hand below.
+	db.stopCompactor()
+
+	if err := db.Put("deleted", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("filler", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		if _, err := db.Get("deleted"); err != ErrNotFound {
+			t.Errorf("Expected deleted key to be not found, got %v", err)
+		}
+		if value, err := db.Get("kept"); err != nil || value != "value" {
+			t.Errorf("Bad value of kept key: %s, %v", value, err)
+		}
+	}
+	check()
+
+	db.mu.Lock()
+	n := len(db.segments) - 1
+	db.mu.Unlock()
+	if n < 2 {
+		t.Fatalf("Expected entries to span several segments, got %d", n+1)
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if _, ok := db.segments[0].index["deleted"]; ok {
+		t.Error("Tombstone was not dropped during compaction")
+	}
+}
+
+func benchmarkPut(b *testing.B, d Durability, parallel bool) {
+	dir, err := ioutil.TempDir(".", "bench-db-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100*segmentSize, WithDurability(d))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	// Keep compaction out of the measurements.
+	db.stopCompactor()
+
+	put := func(i int) {
+		key := fmt.Sprintf("key%d", i%1000)
+		if err := db.Put(key, "value"); err != nil {
+			b.Error(err)
+		}
+	}
+	b.ResetTimer()
+	if !parallel {
+		for i := 0; i < b.N; i++ {
+			put(i)
+		}
+		return
+	}
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			put(i)
+		}
+	})
+}
+
+// With group commit concurrent puts share write and fsync calls, so the
+// parallel benchmarks should be considerably faster per operation.
+func BenchmarkDb_Put(b *testing.B) {
+	b.Run("never", func(b *testing.B) { benchmarkPut(b, Durability{Mode: SyncNever}, false) })
+	b.Run("never-parallel", func(b *testing.B) { benchmarkPut(b, Durability{Mode: SyncNever}, true) })
+	b.Run("always", func(b *testing.B) { benchmarkPut(b, Durability{Mode: SyncAlways}, false) })
+	b.Run("always-parallel", func(b *testing.B) { benchmarkPut(b, Durability{Mode: SyncAlways}, true) })
+}
+
+func TestDb_TTL(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Compaction is started by hand below.
+	db.stopCompactor()
+
+	if err := db.Put("session", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("session", "value", WithTTL(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "value", WithTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("session"); err != nil || value != "value" {
+		t.Errorf("Bad value before expiry: %s, %v", value, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get("session"); err != ErrNotFound {
+		t.Errorf("Expected expired key to be not found, got %v", err)
+	}
+	if _, err := db.PutIfAbsent("other", "value", WithTTL(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.segments[0].index["session"]; ok {
+		t.Error("Expired key was not dropped during compaction")
+	}
+	if value, err := db.Get("kept"); err != nil || value != "value" {
+		t.Errorf("Bad value of kept key: %s, %v", value, err)
+	}
+}
+
+func BenchmarkDb_Get(b *testing.B) {
+	dir, err := ioutil.TempDir(".", "bench-db-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100*KB)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// Wait for the segments to be merged, so the layout doesn't change while
+	// measuring.
+	if err := db.Compact(); err != nil {
+		b.Fatal(err)
+	}
+	db.stopCompactor()
+
+	get := func(i int) {
+		if _, err := db.Get(fmt.Sprintf("key%d", i%keys)); err != nil {
+			b.Error(err)
+		}
+	}
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			get(i)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				get(i)
+			}
+		})
+	})
+	b.Run("missing", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(fmt.Sprintf("missing%d", i)); err != ErrNotFound {
+				b.Error(err)
+			}
+		}
+	})
+}
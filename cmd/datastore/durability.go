@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncMode tells when appended entries are flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncMode = iota
+	// SyncAlways flushes the segment after every write.
+	SyncAlways
+	// SyncInterval flushes the segment periodically, so every write
+	// waits for the next flush.
+	SyncInterval
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncNever:
+		return "never"
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
+}
+
+// ParseSyncMode converts the name of a mode back to SyncMode.
+func ParseSyncMode(name string) (SyncMode, error) {
+	for _, m := range []SyncMode{SyncNever, SyncAlways, SyncInterval} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return SyncNever, fmt.Errorf("unknown sync mode %q", name)
+}
+
+// Durability defines the guarantee a write has once Put returns.
+type Durability struct {
+	Mode SyncMode
+	// Interval between flushes in the SyncInterval mode.
+	Interval time.Duration
+}
+
+// WithDurability sets when writes are flushed to disk. By default they
+// are never flushed explicitly.
+func WithDurability(d Durability) Option {
+	return func(db *Db) {
+		db.durability = d
+	}
+}
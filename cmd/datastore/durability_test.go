@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDb_Durability(t *testing.T) {
+	for _, d := range []Durability{
+		{Mode: SyncNever},
+		{Mode: SyncAlways},
+		{Mode: SyncInterval, Interval: 10 * time.Millisecond},
+	} {
+		t.Run(d.Mode.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir(".", "test-db-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewDb(dir, segmentSize, WithDurability(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			var wg sync.WaitGroup
+			for _, pair := range pairs {
+				wg.Add(1)
+				go func(key, value string) {
+					defer wg.Done()
+					if err := db.Put(key, value); err != nil {
+						t.Errorf("Cannot put %s: %s", key, err)
+					}
+				}(pair[0], pair[1])
+			}
+			wg.Wait()
+
+			for _, pair := range pairs {
+				value, err := db.Get(pair[0])
+				if err != nil || value != pair[1] {
+					t.Errorf("Bad value of %s: %s, %v", pair[0], value, err)
+				}
+			}
+		})
+	}
+
+	if _, err := NewDb(".", segmentSize, WithDurability(Durability{Mode: SyncInterval})); err == nil {
+		t.Error("Expected an error for a zero sync interval")
+	}
+}
+
+func TestParseSyncMode(t *testing.T) {
+	for _, m := range []SyncMode{SyncNever, SyncAlways, SyncInterval} {
+		parsed, err := ParseSyncMode(m.String())
+		if err != nil || parsed != m {
+			t.Errorf("Cannot parse %s: %v, %v", m, parsed, err)
+		}
+	}
+	if _, err := ParseSyncMode("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrDecryption is returned when a value doesn't authenticate under its
+// key: the record was changed or the key file holds a different key.
+var ErrDecryption = fmt.Errorf("cannot decrypt value")
+
+// Keyring holds the AES-GCM keys values are encrypted with. New values are
+// encrypted with the key of the largest id, older keys are kept to read the
+// values written with them until compaction re-encrypts those.
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// NewKeyring creates a keyring of AES keys of 16, 24 or 32 bytes by their
+// positive ids.
+func NewKeyring(keys map[uint32][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption keys")
+	}
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == 0 {
+			return nil, fmt.Errorf("encryption key id must be positive")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		if id > k.active {
+			k.active = id
+		}
+	}
+	return k, nil
+}
+
+// LoadKeyring reads a key file. Every line of it holds a key id and the
+// hex-encoded key separated by a space, empty lines and lines starting
+// with # are skipped. Keys are rotated by adding a line with a larger id.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[uint32][]byte)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key id and a key", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad key id: %w", path, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad key: %w", path, line, err)
+		}
+		if _, ok := keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %d", path, line, id)
+		}
+		keys[uint32(id)] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewKeyring(keys)
+}
+
+// WithEncryption encrypts written values with the active key of the
+// keyring. Keys of entries stay in plaintext, so lookups don't need to
+// decrypt anything but the value they return.
+func WithEncryption(k *Keyring) Option {
+	return func(db *Db) {
+		db.keyring = k
+	}
+}
+
+// encrypt seals the value of a put entry with the active key. The key of
+// the entry is authenticated with it, so a value can't be moved to another
+// key unnoticed.
+func (k *Keyring) encrypt(e entry) (entry, error) {
+	if k == nil || e.kind != kindPut {
+		return e, nil
+	}
+	aead := k.keys[k.active]
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(e.value)+aead.Overhead())
+	_, err := rand.Read(sealed)
+	if err != nil {
+		return entry{}, err
+	}
+	sealed = aead.Seal(sealed, sealed, []byte(e.value), []byte(e.key))
+	e.value = string(sealed)
+	e.keyID = k.active
+	return e, nil
+}
+
+// decrypt restores the value of an encrypted entry. Entries that aren't
+// encrypted are returned as they are.
+func (k *Keyring) decrypt(e entry) (entry, error) {
+	if e.keyID == 0 {
+		return e, nil
+	}
+	if k == nil {
+		return entry{}, fmt.Errorf("value of %s is encrypted and no keys are loaded", e.key)
+	}
+	aead, ok := k.keys[e.keyID]
+	if !ok {
+		return entry{}, fmt.Errorf("value of %s is encrypted with unknown key %d", e.key, e.keyID)
+	}
+	if len(e.value) < aead.NonceSize() {
+		return entry{}, ErrDecryption
+	}
+	sealed := []byte(e.value)
+	value, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(e.key))
+	if err != nil {
+		return entry{}, ErrDecryption
+	}
+	e.value = string(value)
+	e.keyID = 0
+	return e, nil
+}
+
+// rotated tells whether the value of the entry isn't encrypted with the
+// active key.
+func (k *Keyring) rotated(e entry) bool {
+	return k != nil && e.kind == kindPut && e.keyID != k.active
+}
+
+// reencrypt moves the value of the entry under the active key. Values that
+// already use it are kept, so compaction only pays for rotated keys.
+func (k *Keyring) reencrypt(e entry) (entry, error) {
+	if !k.rotated(e) {
+		return e, nil
+	}
+	e, err := k.decrypt(e)
+	if err != nil {
+		return entry{}, err
+	}
+	return k.encrypt(e)
+}
@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-encryption-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys")
+	content := "# rotated on 2026-10-01\n" +
+		"1 000102030405060708090a0b0c0d0e0f\n\n" +
+		"2 101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k.keys) != 2 || k.active != 2 {
+		t.Errorf("Bad keyring loaded: %d keys, active %d", len(k.keys), k.active)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("1 0001\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyring(path); err == nil {
+		t.Error("Expected a short key to be rejected")
+	}
+}
+
+func TestDb_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-encryption-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key1 := bytes.Repeat([]byte{1}, 16)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	open := func(keys map[uint32][]byte) *Db {
+		t.Helper()
+		k, err := NewKeyring(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, segmentSize, WithEncryption(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.stopCompactor()
+		return db
+	}
+	check := func(db *Db) {
+		t.Helper()
+		for _, pair := range pairs {
+			if value, err := db.Get(pair[0]); err != nil || value != pair[1] {
+				t.Errorf("Bad value of %s: %q, %v", pair[0], value, err)
+			}
+		}
+	}
+
+	db := open(map[uint32][]byte{1: key1})
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(db)
+	data, err := ioutil.ReadFile(db.segments[len(db.segments)-1].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(pairs[0][1])) {
+		t.Error("Value is stored in plaintext")
+	}
+	db.Close()
+
+	t.Run("wrong key", func(t *testing.T) {
+		db := open(map[uint32][]byte{1: bytes.Repeat([]byte{3}, 16)})
+		defer db.Close()
+		if _, err := db.Get(pairs[0][0]); !errors.Is(err, ErrDecryption) {
+			t.Errorf("Expected decryption error, got %v", err)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		db := open(map[uint32][]byte{1: key1, 2: key2})
+		check(db)
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		for _, pair := range pairs {
+			e, _, err := db.segments[0].getStored(pair[0])
+			if err != nil || e.keyID != 2 {
+				t.Errorf("Value of %s was not re-encrypted: key %d, %v", pair[0], e.keyID, err)
+			}
+		}
+		db.Close()
+
+		// The old key isn't needed anymore.
+		db = open(map[uint32][]byte{2: key2})
+		defer db.Close()
+		check(db)
+	})
+}
+
+func TestDb_EncryptionMigration(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-encryption-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	// Sealing the plaintext values makes every record longer.
+	k, err := NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, segmentSize, WithEncryption(k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.stopCompactor()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		e, _, err := db.segments[0].getStored(pair[0])
+		if err != nil || e.keyID != 1 {
+			t.Errorf("Value of %s was not encrypted: key %d, %v", pair[0], e.keyID, err)
+		}
+		if value, err := db.Get(pair[0]); err != nil || value != pair[1] {
+			t.Errorf("Bad value of %s: %q, %v", pair[0], value, err)
+		}
+	}
+}
@@ -4,66 +4,330 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
 )
 
+// Segment files start with a header made of a magic string and the format
+// version. Files of older formats are upgraded on recovery.
+const (
+	segmentMagic  = "KVSG"
+	formatVersion = 4
+	headerSize    = len(segmentMagic) + 1
+)
+
+// Every record starts with its total size, a CRC32 of the rest of it, the
+// record kind, the version of the key and flags telling which optional
+// fields follow.
+const recordHeaderSize = 18
+
+// Optional record fields, stored in this order.
+const (
+	// The entry expires at the given time: Unix nanoseconds.
+	flagExpires byte = 1 << iota
+	// The value is compressed with the codec given by a single byte.
+	flagCodec
+	// The value is encrypted with the key of the given 4 byte id.
+	flagEncrypted
+	// The media type of the value, a byte of its size and the type.
+	flagContentType
+)
+
+// maxContentTypeSize is the longest content type a record can hold.
+const maxContentTypeSize = 255
+
+const (
+	kindPut byte = iota
+	kindDelete
+	kindBatch
+)
+
+var (
+	errChecksum  = fmt.Errorf("checksum mismatch")
+	errMalformed = fmt.Errorf("malformed record")
+)
+
+// ErrCorrupted is returned when a record read from a segment file fails
+// validation.
+type ErrCorrupted struct {
+	Segment string
+	Offset  int64
+	Err     error
+}
+
+func (e *ErrCorrupted) Error() string {
+	return fmt.Sprintf("segment %s is corrupted at offset %d: %s", e.Segment, e.Offset, e.Err)
+}
+
+func (e *ErrCorrupted) Unwrap() error {
+	return e.Err
+}
+
+func isCorruption(err error) bool {
+	return err == errChecksum || err == errMalformed || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func fileHeader() []byte {
+	return append([]byte(segmentMagic), formatVersion)
+}
+
 type entry struct {
 	key, value string
+	kind       byte
+	version    uint64
+	// expiresAt is a Unix time in nanoseconds, zero for entries that
+	// never expire.
+	expiresAt int64
+	// The codec the value is compressed with.
+	codec Codec
+	// The id of the key the value is encrypted with, zero for values
+	// stored in plaintext.
+	keyID uint32
+	// The media type the value was written with, empty when unknown.
+	contentType string
+	// Holds the value of a long put entry instead of value until it is
+	// written.
+	spool *spooledValue
+	// The operations of a batch entry, decoded from its value.
+	ops []entry
+}
+
+func (e entry) withVersion(version uint64) entry {
+	e.version = version
+	return e
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now.UnixNano()
+}
+
+func (e *entry) flags() byte {
+	var flags byte
+	if e.expiresAt != 0 {
+		flags |= flagExpires
+	}
+	if e.codec != NoCompression {
+		flags |= flagCodec
+	}
+	if e.keyID != 0 {
+		flags |= flagEncrypted
+	}
+	if e.contentType != "" {
+		flags |= flagContentType
+	}
+	return flags
+}
+
+func (e *entry) headerSize() int {
+	size := recordHeaderSize
+	if e.expiresAt != 0 {
+		size += 8
+	}
+	if e.codec != NoCompression {
+		size++
+	}
+	if e.keyID != 0 {
+		size += 4
+	}
+	if e.contentType != "" {
+		size += 1 + len(e.contentType)
+	}
+	return size
+}
+
+func (e *entry) encodedSize() int {
+	return len(e.key) + len(e.value) + e.headerSize() + 8
 }
 
 func (e *entry) Encode() []byte {
+	res := e.encodeHead(int64(len(e.value)))
+	res = append(res, e.value...)
+	binary.LittleEndian.PutUint32(res[4:], crc32.ChecksumIEEE(res[8:]))
+	return res
+}
+
+// encodeHead encodes the record of the entry up to its value, which is
+// valueSize bytes long. The checksum is left for the caller to fill in.
+func (e *entry) encodeHead(valueSize int64) []byte {
+	h := e.headerSize()
 	kl := len(e.key)
-	vl := len(e.value)
-	size := kl + vl + 12
-	res := make([]byte, size)
-	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
+	res := make([]byte, h+kl+8, e.encodedSize())
+	binary.LittleEndian.PutUint32(res, uint32(int64(h+kl+8)+valueSize))
+	res[8] = e.kind
+	binary.LittleEndian.PutUint64(res[9:], e.version)
+	res[17] = e.flags()
+	pos := recordHeaderSize
+	if e.expiresAt != 0 {
+		binary.LittleEndian.PutUint64(res[pos:], uint64(e.expiresAt))
+		pos += 8
+	}
+	if e.codec != NoCompression {
+		res[pos] = byte(e.codec)
+		pos++
+	}
+	if e.keyID != 0 {
+		binary.LittleEndian.PutUint32(res[pos:], e.keyID)
+		pos += 4
+	}
+	if e.contentType != "" {
+		res[pos] = byte(len(e.contentType))
+		copy(res[pos+1:], e.contentType)
+	}
+	binary.LittleEndian.PutUint32(res[h:], uint32(kl))
+	copy(res[h+4:], e.key)
+	binary.LittleEndian.PutUint32(res[h+kl+4:], uint32(valueSize))
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
+func (e *entry) Decode(input []byte) error {
+	if len(input) < recordHeaderSize+8 || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return errMalformed
+	}
+	if crc32.ChecksumIEEE(input[8:]) != binary.LittleEndian.Uint32(input[4:]) {
+		return errChecksum
+	}
+	h, err := e.decodeHead(input, len(input))
+	if err != nil {
+		return err
+	}
+	valBuf := make([]byte, len(input)-h)
+	copy(valBuf, input[h:])
+	e.value = string(valBuf)
+	e.ops = nil
+	if e.kind == kindBatch {
+		e.ops, err = decodeBatch(e.value)
+	}
+	return err
+}
+
+// maxFieldsSize is the longest a record can be before its key.
+const maxFieldsSize = recordHeaderSize + 8 + 1 + 4 + 1 + maxContentTypeSize + 4
+
+// decodeHead decodes the record of the given size up to its value from a
+// prefix of the record that holds the key. It returns the offset of the
+// value in the record. The checksum isn't verified.
+func (e *entry) decodeHead(input []byte, size int) (int, error) {
+	h, err := e.decodeFields(input)
+	if err != nil {
+		return 0, err
+	}
+	kl := int(binary.LittleEndian.Uint32(input[h:]))
+	if h+kl+8 > len(input) {
+		return 0, errMalformed
+	}
 	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
+	copy(keyBuf, input[h+4:h+kl+4])
 	e.key = string(keyBuf)
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
-	e.value = string(valBuf)
+	vl := int(binary.LittleEndian.Uint32(input[h+kl+4:]))
+	if h+kl+8+vl != size {
+		return 0, errMalformed
+	}
+	return h + kl + 8, nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
-	if err != nil {
-		return "", err
+// decodeFields decodes the fields of a record stored before its key from a
+// prefix of the record. It returns the offset of the key size.
+func (e *entry) decodeFields(input []byte) (int, error) {
+	h := recordHeaderSize
+	if len(input) < h+8 {
+		return 0, errMalformed
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", err
+	e.kind = input[8]
+	if e.kind > kindBatch {
+		return 0, errMalformed
+	}
+	e.version = binary.LittleEndian.Uint64(input[9:])
+	flags := input[17]
+	if flags&^(flagExpires|flagCodec|flagEncrypted|flagContentType) != 0 {
+		return 0, errMalformed
+	}
+	e.expiresAt = 0
+	if flags&flagExpires != 0 {
+		if h+8+8 > len(input) {
+			return 0, errMalformed
+		}
+		e.expiresAt = int64(binary.LittleEndian.Uint64(input[h:]))
+		h += 8
+	}
+	e.codec = NoCompression
+	if flags&flagCodec != 0 {
+		if h+1+8 > len(input) {
+			return 0, errMalformed
+		}
+		e.codec = Codec(input[h])
+		if e.codec == NoCompression || e.codec > Flate {
+			return 0, errMalformed
+		}
+		h++
+	}
+	e.keyID = 0
+	if flags&flagEncrypted != 0 {
+		if h+4+8 > len(input) {
+			return 0, errMalformed
+		}
+		e.keyID = binary.LittleEndian.Uint32(input[h:])
+		if e.keyID == 0 {
+			return 0, errMalformed
+		}
+		h += 4
 	}
+	e.contentType = ""
+	if flags&flagContentType != 0 {
+		if h+1+8 > len(input) {
+			return 0, errMalformed
+		}
+		size := int(input[h])
+		if size == 0 || h+1+size+8 > len(input) {
+			return 0, errMalformed
+		}
+		e.contentType = string(input[h+1 : h+1+size])
+		h += 1 + size
+	}
+	return h, nil
+}
 
-	header, err = in.Peek(4)
+// readRecord reads a single size-prefixed record.
+func readRecord(in io.Reader) ([]byte, error) {
+	var header [4]byte
+	_, err := io.ReadFull(in, header[:])
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size < uint32(len(header)) {
+		return nil, errMalformed
+	}
+	data := make([]byte, size)
+	copy(data, header[:])
+	_, err = io.ReadFull(in, data[len(header):])
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
 	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return data, nil
+}
 
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+func readEntry(in *bufio.Reader) (entry, error) {
+	var e entry
+	data, err := readRecord(in)
 	if err != nil {
-		return "", err
-	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+		return e, err
 	}
+	err = e.Decode(data)
+	return e, err
+}
 
-	return string(data), nil
+func readValue(in *bufio.Reader) (string, error) {
+	e, err := readEntry(in)
+	if err == nil {
+		e, err = openValue(e, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	return e.value, nil
 }
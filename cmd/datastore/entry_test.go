@@ -3,11 +3,12 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"reflect"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -18,7 +19,7 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
@@ -28,3 +29,40 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bat value [%s]", v)
 	}
 }
+
+func TestEntry_Checksum(t *testing.T) {
+	e := entry{key: "key", value: "value"}
+	data := e.Encode()
+	data[len(data)-1] ^= 0xff
+	if err := e.Decode(data); err != errChecksum {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+	if _, err := readValue(bufio.NewReader(bytes.NewReader(data))); err != errChecksum {
+		t.Errorf("Expected checksum error from readValue, got %v", err)
+	}
+}
+
+func TestEntry_Expiry(t *testing.T) {
+	e := entry{key: "key", value: "value", version: 3, expiresAt: 42}
+	var decoded entry
+	if err := decoded.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, e) {
+		t.Errorf("Bad entry decoded: %+v", decoded)
+	}
+	if len(e.Encode()) != (&entry{key: "key", value: "value"}).encodedSize()+8 {
+		t.Error("Expiry time should only be stored when set")
+	}
+}
+
+func TestEntry_ContentType(t *testing.T) {
+	e := entry{key: "key", value: "\x00\xff", version: 1, keyID: 2, contentType: "image/png"}
+	var decoded entry
+	if err := decoded.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, e) {
+		t.Errorf("Bad entry decoded: %+v", decoded)
+	}
+}
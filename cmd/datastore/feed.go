@@ -0,0 +1,251 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultChangeRetention is how many of the latest changes a Db keeps for
+// watchers to resume from.
+const DefaultChangeRetention = 10000
+
+// Changes read from the feed at once by a watcher.
+const watchReadSize = 256
+
+var (
+	// ErrSequenceExpired is returned by watches resuming from a sequence
+	// whose following changes are no longer retained.
+	ErrSequenceExpired = fmt.Errorf("changes after the sequence are no longer retained")
+	// ErrUnknownSequence is returned by watches resuming from a sequence
+	// the database hasn't reached, like one of a database restored from an
+	// older backup.
+	ErrUnknownSequence = fmt.Errorf("sequence is ahead of the database")
+)
+
+// Change is a put or a delete of a key. Keys expiring don't make changes.
+type Change struct {
+	// Sequence orders the changes. It is the version the change gave the
+	// key, so all operations of a batch share it.
+	Sequence uint64
+	Key      string
+	Deleted  bool
+}
+
+// WithChangeRetention sets how many of the latest changes are kept in
+// memory for watchers to resume from.
+func WithChangeRetention(n int) Option {
+	return func(db *Db) {
+		db.changeRetention = n
+	}
+}
+
+// changeFeed keeps the latest changes of the database. Writes finish out of
+// order, so the changes of a version are held back until all lower
+// versions are resolved, and watchers see the sequence only grow.
+type changeFeed struct {
+	mu        sync.Mutex
+	retention int
+	// Published changes in order, up to twice the retention.
+	changes []Change
+	// Changes up to the floor sequence aren't retained.
+	floor uint64
+	// The latest resolved version, versions resolved out of order wait in
+	// pending.
+	last    uint64
+	pending map[uint64][]Change
+	// Closed and replaced whenever changes are published.
+	notify chan struct{}
+	closed bool
+}
+
+// newChangeFeed starts a feed after the version, changes up to it are
+// not retained.
+func newChangeFeed(retention int, version uint64) *changeFeed {
+	if retention <= 0 {
+		retention = DefaultChangeRetention
+	}
+	return &changeFeed{
+		retention: retention,
+		floor:     version,
+		last:      version,
+		pending:   make(map[uint64][]Change),
+		notify:    make(chan struct{}),
+	}
+}
+
+// changesOf returns the changes made by the written entry.
+func changesOf(e entry) []Change {
+	ops := []entry{e}
+	if e.kind == kindBatch {
+		ops = e.ops
+	}
+	changes := make([]Change, len(ops))
+	for i, op := range ops {
+		changes[i] = Change{e.version, op.key, op.kind == kindDelete}
+	}
+	return changes
+}
+
+// resolve publishes the changes written with the version, none when the
+// write failed. Every version given to a write has to be resolved once.
+func (f *changeFeed) resolve(version uint64, changes []Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending[version] = changes
+	published := false
+	for {
+		next, ok := f.pending[f.last+1]
+		if !ok {
+			break
+		}
+		delete(f.pending, f.last+1)
+		f.last++
+		f.changes = append(f.changes, next...)
+		published = published || len(next) > 0
+	}
+	if len(f.changes) >= 2*f.retention {
+		drop := len(f.changes) - f.retention
+		f.floor = f.changes[drop-1].Sequence
+		f.changes = append([]Change(nil), f.changes[drop:]...)
+	}
+	if published && !f.closed {
+		close(f.notify)
+		f.notify = make(chan struct{})
+	}
+}
+
+// read returns up to about max changes after the sequence and a channel
+// closed once more changes are published. Changes of a sequence are
+// returned together.
+func (f *changeFeed) read(since uint64, max int) ([]Change, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, nil, ErrClosed
+	}
+	if since < f.floor {
+		return nil, nil, ErrSequenceExpired
+	}
+	if since > f.last {
+		return nil, nil, ErrUnknownSequence
+	}
+	start := sort.Search(len(f.changes), func(i int) bool {
+		return f.changes[i].Sequence > since
+	})
+	end := start + max
+	if end > len(f.changes) {
+		end = len(f.changes)
+	}
+	for end < len(f.changes) && f.changes[end].Sequence == f.changes[end-1].Sequence {
+		end++
+	}
+	return append([]Change(nil), f.changes[start:end]...), f.notify, nil
+}
+
+func (f *changeFeed) sequence() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last
+}
+
+// close wakes up the waiting watchers.
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.notify)
+	}
+}
+
+// Sequence returns the sequence of the latest change. Watching from it
+// returns the changes made from now on.
+func (db *Db) Sequence() uint64 {
+	return db.feed.sequence()
+}
+
+// Watch returns a watcher of the changes of keys with the prefix made after
+// the sequence. Only the latest changes since the Db was opened are kept,
+// older sequences fail with ErrSequenceExpired and sequences the Db hasn't
+// reached with ErrUnknownSequence.
+func (db *Db) Watch(prefix string, since uint64) (*Watcher, error) {
+	return db.watch(prefix, "", since)
+}
+
+func (db *Db) watch(prefix, trim string, since uint64) (*Watcher, error) {
+	_, _, err := db.feed.read(since, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{feed: db.feed, prefix: prefix, trim: trim, since: since}, nil
+}
+
+// Watch is Db.Watch for the keys of the bucket.
+func (b *Bucket) Watch(prefix string, since uint64) (*Watcher, error) {
+	if b.prefix == "" {
+		return b.db.Watch(prefix, since)
+	}
+	stored, err := b.key(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return b.db.watch(stored, b.prefix, since)
+}
+
+// Watcher reads the changes of the watched keys in order of their
+// sequences.
+type Watcher struct {
+	feed *changeFeed
+	// Prefix of the watched stored keys and the part of it trimmed from
+	// the returned keys, which is the bucket prefix.
+	prefix string
+	trim   string
+	// The sequence of the latest change read from the feed.
+	since uint64
+	read  []Change
+}
+
+// Next waits for the next write changing the watched keys and returns its
+// changes, several for a batch. It fails with ErrSequenceExpired when the
+// watcher falls behind the retained changes, with ErrClosed once the Db is
+// closed, and with the error of the context when it is done.
+func (w *Watcher) Next(ctx context.Context) ([]Change, error) {
+	for len(w.read) == 0 {
+		changes, notify, err := w.feed.read(w.since, watchReadSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			select {
+			case <-notify:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		w.since = changes[len(changes)-1].Sequence
+		for _, c := range changes {
+			if w.matches(c.Key) {
+				c.Key = c.Key[len(w.trim):]
+				w.read = append(w.read, c)
+			}
+		}
+	}
+	n := 1
+	for n < len(w.read) && w.read[n].Sequence == w.read[0].Sequence {
+		n++
+	}
+	changes := w.read[:n:n]
+	w.read = w.read[n:]
+	return changes, nil
+}
+
+func (w *Watcher) matches(key string) bool {
+	if w.trim == "" && checkUserKey(key) != nil {
+		return false
+	}
+	return strings.HasPrefix(key, w.prefix)
+}
@@ -0,0 +1,194 @@
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func nextChanges(t *testing.T, w *Watcher) []Change {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changes, err := w.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-watch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w, err := db.Watch("user:", db.Sequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := db.CreateBucket("bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := bucket.Watch("user:", db.Sequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put, err := db.PutVersioned("user:1", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put("user:2", "c"); err != nil {
+		t.Fatal(err)
+	}
+	batch := db.NewBatch()
+	batch.Put("user:3", "d")
+	batch.Delete("user:1")
+	batch.Put("other", "e")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := nextChanges(t, w); !reflect.DeepEqual(got, []Change{{put, "user:1", false}}) {
+		t.Errorf("Bad changes of a put: %+v", got)
+	}
+	got := nextChanges(t, w)
+	if len(got) != 2 || got[0].Key != "user:3" || got[1].Key != "user:1" || !got[1].Deleted ||
+		got[0].Sequence != got[1].Sequence || got[0].Sequence <= put {
+		t.Errorf("Bad changes of a batch: %+v", got)
+	}
+	if got := nextChanges(t, bw); len(got) != 1 || got[0].Key != "user:2" {
+		t.Errorf("Bad changes of the bucket: %+v", got)
+	}
+
+	// A watcher resumes after the last change it saw.
+	resumed, err := db.Watch("", put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := nextChanges(t, resumed); len(got) != 1 || got[0].Key != "other" {
+		t.Errorf("Bad changes of a resumed watcher: %+v", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := w.Next(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Next without changes: got %v", err)
+	}
+}
+
+func TestDb_WatchRetention(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-watch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1024, WithChangeRetention(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := db.Sequence()
+	w, err := db.Watch("", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Watch("", start); err != ErrSequenceExpired {
+		t.Errorf("Watch from an expired sequence: got %v", err)
+	}
+	if _, err := w.Next(context.Background()); err != ErrSequenceExpired {
+		t.Errorf("Next of a watcher behind the retention: got %v", err)
+	}
+
+	// Changes before the Db was opened aren't retained.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Watch("", start); err != ErrSequenceExpired {
+		t.Errorf("Watch from before reopening: got %v", err)
+	}
+	if _, err := db.Watch("", db.Sequence()+1); err != ErrUnknownSequence {
+		t.Errorf("Watch from a sequence ahead of the Db: got %v", err)
+	}
+	w, err = db.Watch("", db.Sequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := w.Next(context.Background())
+		done <- err
+	}()
+	db.Close()
+	if err := <-done; err != ErrClosed {
+		t.Errorf("Next after closing: got %v", err)
+	}
+}
+
+func TestDb_WatchConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-watch-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Small segments make writes roll over and get new versions.
+	db, err := NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	w, err := db.Watch("", db.Sequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, writes = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				if err := db.Put(string(rune('a'+i)), "value"); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var last uint64
+	for n := 0; n < writers*writes; n++ {
+		changes := nextChanges(t, w)
+		if changes[0].Sequence <= last {
+			t.Fatalf("Sequence %d after %d", changes[0].Sequence, last)
+		}
+		last = changes[0].Sequence
+	}
+}
@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+)
+
+// Hint files hold the index of a sealed segment so recovery doesn't have
+// to read the segment record by record. The file is laid out as
+//
+//	magic | segment format | segment size | max version | (key size | key | offset | size)... | crc
+//
+// where the trailing CRC32 covers everything before it.
+const (
+	hintMagic  = "KVSH"
+	hintSuffix = ".hint"
+)
+
+func hintPath(segmentPath string) string {
+	return segmentPath + hintSuffix
+}
+
+func encodeHint(index hashIndex, segmentSize int64, maxVersion uint64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(hintMagic)
+	buf.WriteByte(formatVersion)
+	var scratch [8]byte
+	binary.LittleEndian.PutUint64(scratch[:], uint64(segmentSize))
+	buf.Write(scratch[:])
+	binary.LittleEndian.PutUint64(scratch[:], maxVersion)
+	buf.Write(scratch[:])
+	for key, pos := range index {
+		binary.LittleEndian.PutUint32(scratch[:], uint32(len(key)))
+		buf.Write(scratch[:4])
+		buf.WriteString(key)
+		binary.LittleEndian.PutUint64(scratch[:], uint64(pos.offset))
+		buf.Write(scratch[:])
+		binary.LittleEndian.PutUint32(scratch[:], pos.size)
+		buf.Write(scratch[:4])
+	}
+	binary.LittleEndian.PutUint32(scratch[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(scratch[:4])
+	return buf.Bytes()
+}
+
+// hint is the decoded content of a hint file.
+type hint struct {
+	index       hashIndex
+	segmentSize int64
+	maxVersion  uint64
+}
+
+func decodeHint(data []byte) (*hint, error) {
+	const header = len(hintMagic) + 17
+	if len(data) < header+4 || string(data[:len(hintMagic)]) != hintMagic {
+		return nil, errMalformed
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, errChecksum
+	}
+	if body[len(hintMagic)] != formatVersion {
+		return nil, errMalformed
+	}
+	segmentSize := int64(binary.LittleEndian.Uint64(body[len(hintMagic)+1:]))
+	maxVersion := binary.LittleEndian.Uint64(body[len(hintMagic)+9:])
+
+	index := hashIndex{}
+	for pos := header; pos < len(body); {
+		if pos+4 > len(body) {
+			return nil, errMalformed
+		}
+		kl := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		if pos+kl+12 > len(body) {
+			return nil, errMalformed
+		}
+		key := string(body[pos : pos+kl])
+		pos += kl
+		offset := int64(binary.LittleEndian.Uint64(body[pos:]))
+		size := binary.LittleEndian.Uint32(body[pos+8:])
+		pos += 12
+		if offset < int64(headerSize) || offset+int64(size) > segmentSize {
+			return nil, errMalformed
+		}
+		index[key] = recordPos{offset, size}
+	}
+	return &hint{index, segmentSize, maxVersion}, nil
+}
+
+// writeHint stores the index of the segment next to it.
+func (sgm *Segment) writeHint() error {
+	sgm.mu.Lock()
+	data := encodeHint(sgm.index, sgm.outOffset, sgm.maxVersion)
+	sgm.mu.Unlock()
+	return ioutil.WriteFile(hintPath(sgm.path), data, 0o600)
+}
+
+// loadHint fills the segment index from its hint file. It reports false
+// when there is no usable hint and the segment has to be scanned.
+func (sgm *Segment) loadHint() bool {
+	data, err := ioutil.ReadFile(hintPath(sgm.path))
+	if err != nil {
+		return false
+	}
+	h, err := decodeHint(data)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(sgm.path)
+	if err != nil || info.Size() != h.segmentSize {
+		return false
+	}
+	sgm.index = h.index
+	sgm.outOffset = h.segmentSize
+	sgm.maxVersion = h.maxVersion
+	return true
+}
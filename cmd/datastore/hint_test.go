@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestHint_Encode(t *testing.T) {
+	index := hashIndex{
+		"key1": {offset: int64(headerSize), size: 20},
+		"key2": {offset: int64(headerSize) + 20, size: 30},
+	}
+	decoded, err := decodeHint(encodeHint(index, 55, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.segmentSize != 55 || decoded.maxVersion != 7 {
+		t.Errorf("Bad segment size %d or version %d", decoded.segmentSize, decoded.maxVersion)
+	}
+	if !reflect.DeepEqual(decoded.index, index) {
+		t.Errorf("Bad index decoded: %v", decoded.index)
+	}
+
+	data := encodeHint(index, 55, 7)
+	data[len(hintMagic)+10] ^= 0xff
+	if _, err := decodeHint(data); err != errChecksum {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+}
+
+func TestHint_Recovery(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-hint-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	sgm := db.segments[len(db.segments)-1]
+
+	// The first restart scans the segment and leaves a hint for the next one.
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	recovered := &Segment{path: sgm.path, index: hashIndex{}}
+	if !recovered.loadHint() {
+		t.Fatal("Hint file was not written on recovery")
+	}
+	if !reflect.DeepEqual(recovered.index, sgm.index) {
+		t.Errorf("Hint index %v differs from the scanned one %v", recovered.index, sgm.index)
+	}
+
+	t.Run("stale hint", func(t *testing.T) {
+		f, err := os.OpenFile(sgm.path, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write((&entry{key: pairs[0][0], value: "updated"}).Encode())
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stale, err := NewSegment(sgm.path, segmentSize, false, Durability{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stale.recover(false); err != nil {
+			t.Fatal(err)
+		}
+		value, err := stale.Get(pairs[0][0])
+		if err != nil || value != "updated" {
+			t.Errorf("Stale hint was used: %s, %v", value, err)
+		}
+	})
+}
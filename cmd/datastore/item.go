@@ -0,0 +1,54 @@
+package datastore
+
+// Item is a value read together with what is stored along with it.
+type Item struct {
+	Value   []byte
+	Version uint64
+	// The media type the value was written with, empty when it was
+	// written without one.
+	ContentType string
+}
+
+// WithContentType records the media type of the value, so readers can
+// tell how to interpret it. It is kept until the key is overwritten.
+func WithContentType(contentType string) WriteOption {
+	return func(e *entry) {
+		e.contentType = contentType
+	}
+}
+
+// PutBytes stores a binary value. Values are kept as they are, so any byte
+// sequence can be stored and read back with GetBytes.
+func (db *Db) PutBytes(key string, value []byte, opts ...WriteOption) error {
+	return db.Put(key, string(value), opts...)
+}
+
+// GetBytes returns the value of the key as a byte slice owned by the
+// caller.
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	item, err := db.GetItem(key)
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// GetItem returns the value of the key with its version and content type.
+func (db *Db) GetItem(key string) (Item, error) {
+	if err := checkUserKey(key); err != nil {
+		return Item{}, err
+	}
+	return db.getItem(key)
+}
+
+func (db *Db) getItem(key string) (Item, error) {
+	e, err := db.getEntry(key)
+	if err != nil {
+		return Item{}, err
+	}
+	return Item{
+		Value:       []byte(e.value),
+		Version:     e.version,
+		ContentType: e.contentType,
+	}, nil
+}
@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_Bytes(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-bytes-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.stopCompactor()
+
+	blob := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe, '\n'}
+	if err := db.PutBytes("image", blob, WithContentType("image/png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("text", "plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBytes("image", blob, WithContentType(strings.Repeat("x", maxContentTypeSize+1))); err == nil {
+		t.Error("Too long content type should be rejected")
+	}
+
+	check := func() {
+		t.Helper()
+		item, err := db.GetItem("image")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(item.Value, blob) || item.ContentType != "image/png" {
+			t.Errorf("Bad item: %+v", item)
+		}
+		value, err := db.GetBytes("text")
+		if err != nil || string(value) != "plain" {
+			t.Errorf("Bad value of text: %q, %v", value, err)
+		}
+		item, err = db.GetItem("text")
+		if err != nil || item.ContentType != "" {
+			t.Errorf("Value written without a content type got %q, %v", item.ContentType, err)
+		}
+	}
+	check()
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import "fmt"
+
+// Default limits of a Db.
+const (
+	DefaultMaxKeySize   = 64 * 1024
+	DefaultMaxValueSize = 1 << 30
+)
+
+// Limits bounds the size of keys and values written to the database.
+// Zero fields take the defaults. Records store sizes in 4 bytes, so a key
+// and a value of the largest sizes have to fit in 4 GiB together.
+type Limits struct {
+	MaxKeySize   int
+	MaxValueSize int64
+}
+
+// WithLimits sets the largest keys and values the database accepts.
+func WithLimits(l Limits) Option {
+	return func(db *Db) {
+		db.limits = l
+	}
+}
+
+// Limits returns the limits of the database with the defaults filled in.
+func (db *Db) Limits() Limits {
+	return db.limits
+}
+
+func (l Limits) withDefaults() (Limits, error) {
+	if l.MaxKeySize == 0 {
+		l.MaxKeySize = DefaultMaxKeySize
+	}
+	if l.MaxValueSize == 0 {
+		l.MaxValueSize = DefaultMaxValueSize
+	}
+	if l.MaxKeySize < 0 || l.MaxValueSize < 0 {
+		return l, fmt.Errorf("size limits must be positive")
+	}
+	if int64(l.MaxKeySize)+l.MaxValueSize+bucketPrefixSize+maxFieldsSize+8 > maxRecordSize {
+		return l, fmt.Errorf("keys of %d bytes with values of %d bytes don't fit in a record",
+			l.MaxKeySize, l.MaxValueSize)
+	}
+	return l, nil
+}
+
+// ErrTooLarge is returned by writes of keys, values or batches over the
+// limits of the database.
+type ErrTooLarge struct {
+	// What is too large, like "key", "value" or "batch".
+	What string
+	// Size is how large it is. Streamed values are read only up to the
+	// first byte over the limit, so it is Limit+1 for them.
+	Size  int64
+	Limit int64
+}
+
+func (e *ErrTooLarge) Error() string {
+	return fmt.Sprintf("%s of %d bytes is over the limit of %d bytes", e.What, e.Size, e.Limit)
+}
+
+// checkKey checks the size of a stored key without its bucket prefix.
+func (db *Db) checkKey(key string) error {
+	size := len(key)
+	if _, ok := bucketOf(key); ok {
+		size -= bucketPrefixSize
+	}
+	if size > db.limits.MaxKeySize {
+		return &ErrTooLarge{"key", int64(size), int64(db.limits.MaxKeySize)}
+	}
+	return nil
+}
+
+func (db *Db) checkValue(size int64) error {
+	if size > db.limits.MaxValueSize {
+		return &ErrTooLarge{"value", size, db.limits.MaxValueSize}
+	}
+	return nil
+}
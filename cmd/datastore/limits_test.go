@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_Limits(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-limits-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewDb(dir, 1024, WithLimits(Limits{MaxValueSize: maxRecordSize})); err == nil {
+		t.Error("Limits over the record size should be rejected")
+	}
+	db, err := NewDb(dir, 1024, WithLimits(Limits{MaxKeySize: 8, MaxValueSize: 2 * streamThreshold}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if l := db.Limits(); l.MaxKeySize != 8 || l.MaxValueSize != 2*streamThreshold {
+		t.Errorf("Bad limits %+v", l)
+	}
+
+	tooLarge := func(what string, err error) {
+		t.Helper()
+		var e *ErrTooLarge
+		if !errors.As(err, &e) || e.What != what {
+			t.Errorf("Expected a too large %s, got %v", what, err)
+		}
+	}
+	longKey := strings.Repeat("k", 9)
+	longValue := strings.Repeat("v", 2*streamThreshold+1)
+	tooLarge("key", db.Put(longKey, "value"))
+	tooLarge("key", db.Delete(longKey))
+	tooLarge("value", db.Put("key", longValue))
+	_, err = db.PutStream("key", strings.NewReader(longValue))
+	tooLarge("value", err)
+	_, err = db.CompareAndSwap("key", 1, longValue)
+	tooLarge("value", err)
+
+	batch := db.NewBatch()
+	batch.Put("key", "value")
+	batch.Delete(longKey)
+	tooLarge("key", batch.Commit())
+
+	if _, err := db.PutStream("key", strings.NewReader(longValue[1:])); err != nil {
+		t.Errorf("Value of the largest size is rejected: %s", err)
+	}
+	if _, err := db.Get(longKey); err != ErrNotFound {
+		t.Errorf("Too long key was written: %v", err)
+	}
+}
+
+func TestDb_EntryLargerThanSegment(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-limits-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.stopCompactor()
+
+	large := bytes.Repeat([]byte{'x'}, 1000)
+	if err := db.Put("small1", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBytes("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small2", "value"); err != nil {
+		t.Fatal(err)
+	}
+	// The large entry doesn't share a segment with the small ones.
+	if len(db.segments) != 3 {
+		t.Errorf("Expected 3 segments, got %d", len(db.segments))
+	}
+	if _, err := db.segments[1].getEntry("large"); err != nil {
+		t.Errorf("Large entry isn't in a segment of its own: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"small1", "small2"} {
+		if value, err := db.Get(key); err != nil || value != "value" {
+			t.Errorf("Bad value of %s: %q, %v", key, value, err)
+		}
+	}
+	if value, err := db.GetBytes("large"); err != nil || !bytes.Equal(value, large) {
+		t.Errorf("Bad large value: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const lockName = "LOCK"
+
+// ErrLocked is returned by NewDb when another Db holds the directory: a
+// writer locks it exclusively, readers opened with WithReadOnly share it.
+var ErrLocked = fmt.Errorf("database directory is locked by another process")
+
+// ErrReadOnly is returned by writes to a Db opened with WithReadOnly.
+var ErrReadOnly = fmt.Errorf("database is opened read-only")
+
+// ErrClosed is returned by writes to a closed Db.
+var ErrClosed = fmt.Errorf("database is closed")
+
+// lockDir takes the lock of the directory, shared or exclusive.
+func lockDir(dir string, shared bool) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f, shared)
+	if err != nil {
+		f.Close()
+		if err == ErrLocked {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlockDir releases the lock taken by lockDir. The lock file itself is
+// kept: removing it would let another process lock a new file while this
+// one still holds the old one.
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
@@ -0,0 +1,160 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDb_Lock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directories aren't locked on Windows")
+	}
+	dir, err := ioutil.TempDir(".", "test-lock-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, readOnly := range []bool{false, true} {
+		_, err := NewDb(dir, 1024, WithReadOnly(readOnly))
+		if !errors.Is(err, ErrLocked) {
+			t.Errorf("Opening a locked directory with readOnly=%t: got %v, want ErrLocked", readOnly, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	closed := db
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatalf("Cannot reopen the closed database: %s", err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Bad value after reopening: %q, %v", value, err)
+	}
+
+	// The closed handle must not write next to the new one.
+	if err := closed.Put("key", "stale"); err != ErrClosed {
+		t.Errorf("Put after Close: got %v, want ErrClosed", err)
+	}
+	b := closed.NewBatch()
+	b.Put("key", "stale")
+	if err := b.Commit(); err != ErrClosed {
+		t.Errorf("Batch after Close: got %v, want ErrClosed", err)
+	}
+	if err := closed.Compact(); err != ErrClosed {
+		t.Errorf("Compact after Close: got %v, want ErrClosed", err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Value changed by the closed handle: %q, %v", value, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, lockName)); err != nil {
+		t.Errorf("Lock file is missing: %s", err)
+	}
+}
+
+func TestDb_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-read-only-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn record at the end of the active segment is left for the next
+	// writable open to truncate.
+	m, _, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := m.segments
+	last := filepath.Join(dir, names[len(names)-1])
+	f, err := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0xff, 0xff, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastInfo, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := NewDb(dir, 1024, WithReadOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewDb(dir, 1024, WithReadOnly(true))
+	if err != nil {
+		t.Fatalf("Read-only databases should share the directory: %s", err)
+	}
+	defer second.Close()
+	if runtime.GOOS != "windows" {
+		if _, err := NewDb(dir, 1024); !errors.Is(err, ErrLocked) {
+			t.Errorf("Opening for writing next to readers: got %v, want ErrLocked", err)
+		}
+	}
+
+	for _, db := range []*Db{first, second} {
+		if value, err := db.Get("key1"); err != nil || value != "value1" {
+			t.Errorf("Bad value of key1: %q, %v", value, err)
+		}
+	}
+	if err := first.Put("key3", "value3"); err != ErrReadOnly {
+		t.Errorf("Put: got %v, want ErrReadOnly", err)
+	}
+	if _, err := first.PutIfAbsent("key3", "value3"); err != ErrReadOnly {
+		t.Errorf("PutIfAbsent: got %v, want ErrReadOnly", err)
+	}
+	if err := first.Delete("key1"); err != ErrReadOnly {
+		t.Errorf("Delete: got %v, want ErrReadOnly", err)
+	}
+	if err := first.Compact(); err != ErrReadOnly {
+		t.Errorf("Compact: got %v, want ErrReadOnly", err)
+	}
+
+	after, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("Read-only open changed the directory: %d files before, %d after", len(before), len(after))
+	}
+	if info, err := os.Stat(last); err != nil || info.Size() != lastInfo.Size() {
+		t.Errorf("Read-only open changed the segment: %v, %v", info, err)
+	}
+}
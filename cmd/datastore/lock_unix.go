@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package datastore
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(f *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package datastore
+
+import "os"
+
+// Windows has no flock, the directory isn't locked there.
+func lockFile(f *os.File, shared bool) error {
+	return nil
+}
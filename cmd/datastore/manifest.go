@@ -0,0 +1,152 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// The manifest lists the live segments of the database from the oldest to
+// the newest. It is replaced atomically on every change of the segment set,
+// so after a crash recovery opens exactly the segments it names and any
+// other file in the directory is a leftover. The file is laid out as
+//
+//	magic | manifest format | version | (name size | name)... | crc
+//
+// where the trailing CRC32 covers everything before it. Manifests of
+// format 1 have no version.
+const (
+	manifestMagic   = "KVSM"
+	manifestFormat  = 2
+	manifestName    = "MANIFEST"
+	manifestTmpName = manifestName + ".tmp"
+)
+
+type manifest struct {
+	segments []string
+	// The latest version given to an entry when the manifest was written.
+	// Compaction drops the records of deleted keys, which may hold the
+	// latest versions, so the segments alone can't tell it.
+	version uint64
+}
+
+func encodeManifest(m manifest) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(manifestMagic)
+	buf.WriteByte(manifestFormat)
+	var version [8]byte
+	binary.LittleEndian.PutUint64(version[:], m.version)
+	buf.Write(version[:])
+	var scratch [4]byte
+	for _, name := range m.segments {
+		binary.LittleEndian.PutUint32(scratch[:], uint32(len(name)))
+		buf.Write(scratch[:])
+		buf.WriteString(name)
+	}
+	binary.LittleEndian.PutUint32(scratch[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(scratch[:])
+	return buf.Bytes()
+}
+
+func decodeManifest(data []byte) (manifest, error) {
+	var m manifest
+	header := len(manifestMagic) + 1
+	if len(data) < header+4 || string(data[:len(manifestMagic)]) != manifestMagic {
+		return m, errMalformed
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return m, errChecksum
+	}
+	switch body[len(manifestMagic)] {
+	case 1:
+	case manifestFormat:
+		if len(body) < header+8 {
+			return m, errMalformed
+		}
+		m.version = binary.LittleEndian.Uint64(body[header:])
+		header += 8
+	default:
+		return m, errMalformed
+	}
+	for pos := header; pos < len(body); {
+		if pos+4 > len(body) {
+			return m, errMalformed
+		}
+		size := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		if size == 0 || pos+size > len(body) {
+			return m, errMalformed
+		}
+		m.segments = append(m.segments, string(body[pos:pos+size]))
+		pos += size
+	}
+	return m, nil
+}
+
+// readManifest returns the manifest of dir. It reports false when the
+// directory has no manifest yet.
+func readManifest(dir string) (manifest, bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return manifest{}, false, nil
+	}
+	if err != nil {
+		return manifest{}, false, err
+	}
+	m, err := decodeManifest(data)
+	if err != nil {
+		return manifest{}, false, &ErrCorrupted{filepath.Join(dir, manifestName), 0, err}
+	}
+	return m, true, nil
+}
+
+// writeManifest replaces the manifest of dir with the given segments and
+// the latest version given to an entry.
+func writeManifest(dir string, segments []*Segment, version uint64) error {
+	names := make([]string, len(segments))
+	for i, sgm := range segments {
+		names[i] = filepath.Base(sgm.path)
+	}
+	return replaceFile(dir, manifestName, encodeManifest(manifest{names, version}))
+}
+
+// replaceFile writes the file of dir atomically. The content is synced to
+// a temporary file first and renamed over the old file, so a crash leaves
+// either of them in place.
+func replaceFile(dir, name string, data []byte) error {
+	tmpPath := filepath.Join(dir, name+".tmp")
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renames and removals in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifest_Encode(t *testing.T) {
+	m := manifest{[]string{"1", "22", "333"}, 42}
+	decoded, err := decodeManifest(encodeManifest(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, m) {
+		t.Errorf("Bad manifest decoded: %+v", decoded)
+	}
+
+	// Manifests of the first format have no version.
+	old := append([]byte(manifestMagic), 1, 1, 0, 0, 0, '7')
+	old = append(old, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(old[len(old)-4:], crc32.ChecksumIEEE(old[:len(old)-4]))
+	decoded, err = decodeManifest(old)
+	if err != nil || !reflect.DeepEqual(decoded, manifest{segments: []string{"7"}}) {
+		t.Errorf("Bad manifest of format 1 decoded: %+v, %v", decoded, err)
+	}
+
+	data := encodeManifest(m)
+	data[len(manifestMagic)+3] ^= 0xff
+	if _, err := decodeManifest(data); err != errChecksum {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+}
+
+func TestDb_ManifestRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-manifest-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.stopCompactor()
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	m, ok, err := readManifest(dir)
+	if err != nil || !ok {
+		t.Fatalf("Cannot read manifest: %v", err)
+	}
+	names := m.segments
+	if len(names) != len(db.segments) {
+		t.Errorf("Manifest lists %v, expected %d segments", names, len(db.segments))
+	}
+
+	// Files an interrupted compaction, upgrade or manifest update may
+	// leave behind.
+	leftovers := []string{"1", "1" + hintSuffix, legacyMergeName, names[0] + upgradeSuffix, manifestTmpName}
+	for _, name := range leftovers {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("garbage"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files the database doesn't create are kept.
+	if err := ioutil.WriteFile(filepath.Join(dir, "keys"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range leftovers {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Leftover file %s was not removed", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keys")); err != nil {
+		t.Errorf("Unknown file was removed: %s", err)
+	}
+	for _, pair := range pairs {
+		value, err := db.Get(pair[0])
+		if err != nil || value != pair[1] {
+			t.Errorf("Bad value for %s: %q, %v", pair[0], value, err)
+		}
+	}
+}
+
+func TestDb_LegacyDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-manifest-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A directory written before manifests existed, with a merge that was
+	// interrupted before the merged segment was renamed.
+	for name, e := range map[string]entry{
+		"100":           {key: "key", value: "old"},
+		"200":           {key: "key", value: "new"},
+		legacyMergeName: {key: "key", value: "merged"},
+	} {
+		data := append(fileHeader(), e.Encode()...)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key"); err != nil || value != "new" {
+		t.Errorf("Bad value: %q, %v", value, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacyMergeName)); !os.IsNotExist(err) {
+		t.Error("Interrupted merge was not removed")
+	}
+	if _, ok, _ := readManifest(dir); !ok {
+		t.Error("Manifest was not written")
+	}
+}
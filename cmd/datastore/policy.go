@@ -0,0 +1,102 @@
+package datastore
+
+// SegmentInfo describes a sealed segment to a compaction policy.
+type SegmentInfo struct {
+	// Size of the segment file in bytes.
+	Size int64
+	// LiveBytes is the size of the records holding the latest entries of
+	// their keys. The rest of the file is garbage a compaction drops.
+	LiveBytes int64
+}
+
+func (info SegmentInfo) garbage() int64 {
+	garbage := info.Size - int64(headerSize) - info.LiveBytes
+	if garbage < 0 {
+		return 0
+	}
+	return garbage
+}
+
+// CompactionPolicy decides which sealed segments are merged by the
+// background compaction.
+type CompactionPolicy interface {
+	// Pick gets the sealed segments from the oldest to the newest and
+	// returns the range [start, end) of them to merge. An empty range
+	// means there is nothing worth compacting.
+	Pick(segments []SegmentInfo) (start, end int)
+}
+
+// WithCompactionPolicy replaces the default policy, which merges all sealed
+// segments once there are two of them.
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(db *Db) {
+		db.policy = policy
+	}
+}
+
+// SegmentCountPolicy merges all sealed segments once there are at least
+// MinSegments of them.
+type SegmentCountPolicy struct {
+	MinSegments int
+}
+
+func (p SegmentCountPolicy) Pick(segments []SegmentInfo) (int, int) {
+	if len(segments) < 2 || len(segments) < p.MinSegments {
+		return 0, 0
+	}
+	return 0, len(segments)
+}
+
+// GarbageRatioPolicy merges all sealed segments once the share of garbage
+// in them reaches Ratio.
+type GarbageRatioPolicy struct {
+	Ratio float64
+}
+
+func (p GarbageRatioPolicy) Pick(segments []SegmentInfo) (int, int) {
+	var size, garbage int64
+	for _, info := range segments {
+		size += info.Size - int64(headerSize)
+		garbage += info.garbage()
+	}
+	if garbage == 0 || float64(garbage) < p.Ratio*float64(size) {
+		return 0, 0
+	}
+	return 0, len(segments)
+}
+
+// SizeTieredPolicy merges runs of at least MinSegments adjacent segments of
+// similar size, so small segments are merged often and large ones rarely.
+// Sizes are similar when the largest one is at most SizeRatio times the
+// smallest one.
+type SizeTieredPolicy struct {
+	MinSegments int
+	SizeRatio   float64
+}
+
+func (p SizeTieredPolicy) Pick(segments []SegmentInfo) (int, int) {
+	min := p.MinSegments
+	if min < 2 {
+		min = 2
+	}
+	for start := 0; start+min <= len(segments); start++ {
+		smallest, largest := segments[start].Size, segments[start].Size
+		end := start + 1
+		for ; end < len(segments); end++ {
+			size := segments[end].Size
+			if size < smallest {
+				smallest = size
+			}
+			if size > largest {
+				largest = size
+			}
+			if float64(largest) > p.SizeRatio*float64(smallest) {
+				break
+			}
+		}
+		if end-start >= min {
+			return start, end
+		}
+	}
+	return 0, 0
+}
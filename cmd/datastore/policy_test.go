@@ -0,0 +1,56 @@
+package datastore
+
+import "testing"
+
+func TestCompactionPolicy_Pick(t *testing.T) {
+	h := int64(headerSize)
+	tests := []struct {
+		name       string
+		policy     CompactionPolicy
+		segments   []SegmentInfo
+		start, end int
+	}{
+		{
+			name:     "count below minimum",
+			policy:   SegmentCountPolicy{MinSegments: 3},
+			segments: []SegmentInfo{{Size: 100}, {Size: 100}},
+		},
+		{
+			name:     "count reached",
+			policy:   SegmentCountPolicy{MinSegments: 3},
+			segments: []SegmentInfo{{Size: 100}, {Size: 100}, {Size: 100}},
+			end:      3,
+		},
+		{
+			name:     "little garbage",
+			policy:   GarbageRatioPolicy{Ratio: 0.5},
+			segments: []SegmentInfo{{Size: h + 100, LiveBytes: 80}, {Size: h + 100, LiveBytes: 100}},
+		},
+		{
+			name:     "much garbage",
+			policy:   GarbageRatioPolicy{Ratio: 0.5},
+			segments: []SegmentInfo{{Size: h + 100, LiveBytes: 10}, {Size: h + 100, LiveBytes: 60}},
+			end:      2,
+		},
+		{
+			name:     "no similar run",
+			policy:   SizeTieredPolicy{MinSegments: 3, SizeRatio: 2},
+			segments: []SegmentInfo{{Size: 1000}, {Size: 100}, {Size: 10}, {Size: 100}},
+		},
+		{
+			name:     "run of small segments",
+			policy:   SizeTieredPolicy{MinSegments: 3, SizeRatio: 2},
+			segments: []SegmentInfo{{Size: 1000}, {Size: 100}, {Size: 120}, {Size: 90}, {Size: 500}},
+			start:    1,
+			end:      4,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end := tc.policy.Pick(tc.segments)
+			if start != tc.start || end != tc.end {
+				t.Errorf("Got range [%d, %d), expected [%d, %d)", start, end, tc.start, tc.end)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"sort"
+	"time"
+)
+
+// ScanOptions limit the keys returned by Scan and ScanPrefix.
+type ScanOptions struct {
+	// Limit is the maximum number of keys returned, zero means no limit.
+	Limit int
+	// Reverse returns keys in descending order.
+	Reverse bool
+}
+
+// Iterator walks over the keys of a scan in order. Deleted and expired
+// keys are skipped.
+type Iterator struct {
+	db       *Db
+	keys     []string
+	segments map[string]*Segment
+	limit    int
+	returned int
+	current  entry
+	err      error
+	// Prefix of the stored keys trimmed from the returned ones.
+	trim string
+}
+
+// Scan iterates over the keys in range [start, end). An empty end means
+// the range isn't bounded from above. Keys of named buckets are skipped.
+func (db *Db) Scan(start, end string, opts ScanOptions) *Iterator {
+	if first := PrefixEnd(reservedPrefix); start < first {
+		start = first
+	}
+	return db.scan(start, end, "", opts)
+}
+
+// scan iterates over the stored keys in range [start, end), returning them
+// without the trim prefix.
+func (db *Db) scan(start, end, trim string, opts ScanOptions) *Iterator {
+	db.mu.Lock()
+	sgms := db.segments
+	db.mu.Unlock()
+
+	// Every key is read from the newest segment that holds it.
+	latest := make(map[string]*Segment)
+	for i := len(sgms) - 1; i >= 0; i-- {
+		sgm := sgms[i]
+		sgm.mu.Lock()
+		for key := range sgm.index {
+			if key < start || (end != "" && key >= end) {
+				continue
+			}
+			if _, ok := latest[key]; !ok {
+				latest[key] = sgm
+			}
+		}
+		sgm.mu.Unlock()
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	if opts.Reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	} else {
+		sort.Strings(keys)
+	}
+	return &Iterator{
+		db:       db,
+		keys:     keys,
+		segments: latest,
+		limit:    opts.Limit,
+		trim:     trim,
+	}
+}
+
+// ScanPrefix iterates over the keys starting with prefix.
+func (db *Db) ScanPrefix(prefix string, opts ScanOptions) *Iterator {
+	return db.Scan(prefix, PrefixEnd(prefix), opts)
+}
+
+// PrefixEnd returns the smallest key greater than all keys with the
+// prefix, or an empty string if there is no such key.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Next moves to the next key and reports whether there is one.
+func (it *Iterator) Next() bool {
+	if it.err != nil || (it.limit > 0 && it.returned >= it.limit) {
+		return false
+	}
+	for len(it.keys) > 0 {
+		key := it.keys[0]
+		it.keys = it.keys[1:]
+		e, err := it.segments[key].getEntry(key)
+		if err == errSegmentRemoved {
+			// The segment was merged away, so the key is looked up again.
+			e, err = it.db.getEntry(key)
+			if err == ErrNotFound {
+				continue
+			}
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if e.kind == kindDelete || e.expired(time.Now()) {
+			continue
+		}
+		it.current = e
+		it.returned++
+		return true
+	}
+	return false
+}
+
+func (it *Iterator) Key() string {
+	return it.current.key[len(it.trim):]
+}
+
+func (it *Iterator) Value() string {
+	return it.current.value
+}
+
+func (it *Iterator) Version() uint64 {
+	return it.current.version
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func collect(t *testing.T, it *Iterator) []string {
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key()+"="+it.Value())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-scan-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Keep the keys spread over several segments.
+	db.stopCompactor()
+
+	for _, key := range []string{"user:1:name", "user:2:name", "user:42:age", "user:42:name", "zone"} {
+		if err := db.Put(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("user:42:name", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user:2:name"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		it   *Iterator
+		want []string
+	}{
+		{
+			name: "prefix",
+			it:   db.ScanPrefix("user:42:", ScanOptions{}),
+			want: []string{"user:42:age=old", "user:42:name=new"},
+		},
+		{
+			name: "range",
+			it:   db.Scan("user:1", "user:5", ScanOptions{}),
+			want: []string{"user:1:name=old", "user:42:age=old", "user:42:name=new"},
+		},
+		{
+			name: "unbounded",
+			it:   db.Scan("user:42:name", "", ScanOptions{}),
+			want: []string{"user:42:name=new", "zone=old"},
+		},
+		{
+			name: "reverse with limit",
+			it:   db.ScanPrefix("user:", ScanOptions{Limit: 2, Reverse: true}),
+			want: []string{"user:42:name=new", "user:42:age=old"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := collect(t, tc.it); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Got %v, expected %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, end := range map[string]string{
+		"abc":      "abd",
+		"ab\xff":   "ac",
+		"\xff\xff": "",
+		"":         "",
+	} {
+		if got := PrefixEnd(prefix); got != end {
+			t.Errorf("PrefixEnd(%q) = %q, expected %q", prefix, got, end)
+		}
+	}
+}
@@ -2,188 +2,648 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
 	"sync"
+	"time"
 )
 
-type hashIndex map[string]int64
+type recordPos struct {
+	offset int64
+	size   uint32
+}
+
+type hashIndex map[string]recordPos
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 
+var (
+	errSegmentFull    = fmt.Errorf("segment is full")
+	errDeleted        = fmt.Errorf("record is deleted")
+	errSegmentRemoved = fmt.Errorf("segment is removed")
+)
+
 type Segment struct {
-	path      string
-	active    bool
-	outOffset int64
-	maxSize   int64
-	index     hashIndex
+	path       string
+	active     bool
+	outOffset  int64
+	maxSize    int64
+	durability Durability
+	index      hashIndex
+	maxVersion uint64
+	// Built once the segment is sealed.
+	bloom *bloomFilter
+	// Decrypts values, nil when the database isn't encrypted.
+	keyring *Keyring
+	// Set for segments of a read-only Db, whose recovery must leave the
+	// files as they are.
+	readOnly bool
+	// Read-only handle shared by all lookups. It is opened on the first one
+	// and closed once the segment is removed and its last reader is done.
+	file      *os.File
+	readers   int
+	removed   bool
 	mu        sync.Mutex
+	writeMu   sync.RWMutex
 	writeChan chan InsertQuery
+	writeDone chan struct{}
+	// The error of the flush sealing the segment, set before writeDone is
+	// closed.
+	sealErr error
 }
 
-func NewSegment(path string, maxSize int64, active bool) (*Segment, error) {
+func NewSegment(path string, maxSize int64, active bool, durability Durability) (*Segment, error) {
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0o600)
 	if err != nil {
 		return nil, err
 	}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		_, err = f.Write(fileHeader())
+	}
 	f.Close()
+	if err != nil {
+		return nil, err
+	}
 	sgm := &Segment{
-		path:      path,
-		active:    active,
-		outOffset: 0,
-		maxSize:   maxSize,
-		index:     map[string]int64{},
+		path:       path,
+		active:     active,
+		outOffset:  int64(headerSize),
+		maxSize:    maxSize,
+		durability: durability,
+		index:      hashIndex{},
 	}
 	if active {
-		writeChan := make(chan InsertQuery)
+		writeChan := make(chan InsertQuery, maxBatchSize)
 		sgm.writeChan = writeChan
+		sgm.writeDone = make(chan struct{})
 		go sgm.initWritingThread(writeChan)
 	}
 	return sgm, nil
 }
 
+// Write hands the query to the writing thread. Once the segment stops
+// accepting writes errSegmentFull is returned and the caller should retry
+// with a newer segment.
 func (sgm *Segment) Write(query InsertQuery) error {
-	wChan := sgm.writeChan
-	if wChan == nil {
-		return fmt.Errorf("Can't write to legacy segment")
+	sgm.writeMu.RLock()
+	defer sgm.writeMu.RUnlock()
+	if sgm.writeChan == nil {
+		return errSegmentFull
 	}
-	wChan <- query
+	sgm.writeChan <- query
 	return nil
 }
 
-func (sgm Segment) Close() error {
-	return nil
+func (sgm *Segment) writable() bool {
+	sgm.writeMu.RLock()
+	defer sgm.writeMu.RUnlock()
+	return sgm.writeChan != nil
+}
+
+func (sgm *Segment) Close() error {
+	sgm.mu.Lock()
+	defer sgm.mu.Unlock()
+	if sgm.file == nil || sgm.readers > 0 {
+		return nil
+	}
+	err := sgm.file.Close()
+	sgm.file = nil
+	return err
+}
+
+// acquire returns the read handle of the segment and counts the caller as
+// a reader until release is called. sgm.mu must be held.
+func (sgm *Segment) acquire() (*os.File, error) {
+	if sgm.removed {
+		return nil, errSegmentRemoved
+	}
+	if sgm.file == nil {
+		file, err := os.Open(sgm.path)
+		if err != nil {
+			return nil, err
+		}
+		sgm.file = file
+	}
+	sgm.readers++
+	return sgm.file, nil
+}
+
+func (sgm *Segment) release() {
+	sgm.mu.Lock()
+	sgm.readers--
+	last := sgm.removed && sgm.readers == 0
+	sgm.mu.Unlock()
+	if last {
+		err := sgm.removeFiles()
+		if err != nil {
+			log.Printf("Cannot remove segment %s: %s", sgm.path, err)
+		}
+	}
 }
 
 const bufSize = 8192
 
-func (sgm *Segment) recover() error {
+// maxBatchSize limits the number of queued writes coalesced into a single
+// write call.
+const maxBatchSize = 128
+
+// recover rebuilds the segment index from its hint file or, when there is
+// no valid hint, by reading the segment file. The Bloom filter is loaded or
+// built from the index. A partially written record
+// at the end of the file is truncated away unless strict is set.
+func (sgm *Segment) recover(strict bool) error {
+	format, err := segmentFormat(sgm.path)
+	if err != nil {
+		return err
+	}
+	if format != formatVersion {
+		if sgm.readOnly {
+			return fmt.Errorf("segment %s has format %d and has to be upgraded by a writable Db", sgm.path, format)
+		}
+		err = upgradeSegment(sgm.path, format, strict)
+		if err != nil {
+			return err
+		}
+	}
+	if !sgm.loadHint() {
+		err = sgm.scan(strict)
+		if err != nil {
+			return err
+		}
+		// Recovered segments are never written to again, so the index can
+		// be saved for the next start.
+		if !sgm.readOnly {
+			err = sgm.writeHint()
+			if err != nil {
+				log.Printf("Segment %s: cannot write hint file: %s", sgm.path, err)
+			}
+		}
+	}
+	if !sgm.loadBloom() {
+		if sgm.readOnly {
+			sgm.fillBloom()
+			return nil
+		}
+		err = sgm.buildBloom()
+		if err != nil {
+			log.Printf("Segment %s: cannot write Bloom filter: %s", sgm.path, err)
+		}
+	}
+	return nil
+}
+
+func (sgm *Segment) scan(strict bool) error {
 	input, err := os.Open(sgm.path)
 	if err != nil {
 		return err
 	}
 	defer input.Close()
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
 
-	var buf [bufSize]byte
 	in := bufio.NewReaderSize(input, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
+	_, err = in.Discard(headerSize)
+	if err != nil {
+		return err
+	}
+	sgm.outOffset = int64(headerSize)
+	for sgm.outOffset < size {
+		header, err := in.Peek(4)
+		if err != nil || int64(binary.LittleEndian.Uint32(header)) > size-sgm.outOffset {
+			torn, err := sgm.tornTail(input, size)
+			if err != nil {
 				return err
 			}
-		} else if err != nil {
-			return err
+			if !torn {
+				return &ErrCorrupted{sgm.path, sgm.outOffset, errMalformed}
+			}
+			if strict {
+				return &ErrCorrupted{sgm.path, sgm.outOffset, io.ErrUnexpectedEOF}
+			}
+			if sgm.readOnly {
+				log.Printf("Segment %s: ignoring %d bytes of a partially written record at offset %d",
+					sgm.path, size-sgm.outOffset, sgm.outOffset)
+				return nil
+			}
+			return sgm.truncateTail(size)
 		}
-		size := binary.LittleEndian.Uint32(header)
-
-		if size < bufSize {
-			data = buf[:size]
+		pos := recordPos{sgm.outOffset, binary.LittleEndian.Uint32(header)}
+		var e entry
+		if pos.size > bufSize {
+			// Only the head of a long record is kept in memory, but the
+			// operations of a batch are indexed, so it is read whole.
+			e, _, err = readRecordHead(input, pos)
+			if err == nil && e.kind == kindBatch {
+				e, err = readStored(input, pos)
+			}
+			if err == nil {
+				_, err = input.Seek(pos.offset+int64(pos.size), io.SeekStart)
+				in.Reset(input)
+			}
 		} else {
-			data = make([]byte, size)
+			var data []byte
+			data, err = readRecord(in)
+			if err == nil {
+				err = e.Decode(data)
+			}
 		}
-		n, err = in.Read(data)
-
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
+		if err != nil {
+			if isCorruption(err) {
+				return &ErrCorrupted{sgm.path, sgm.outOffset, err}
 			}
+			return err
+		}
+		sgm.indexEntry(e, pos)
+		sgm.outOffset += int64(pos.size)
+	}
+	return nil
+}
 
-			var e entry
-			e.Decode(data)
-			sgm.index[e.key] = sgm.outOffset
-			sgm.outOffset += int64(n)
+// tornTail tells whether the record at the current offset, whose size
+// reaches past the end of the file, is the partially written last record.
+// A size no write could have made, or a complete record further on that
+// the rest of the file follows, mean the size field is corrupted instead
+// and truncating would drop valid records.
+func (sgm *Segment) tornTail(file io.ReaderAt, size int64) (bool, error) {
+	var head [recordHeaderSize]byte
+	n, err := file.ReadAt(head[:], sgm.outOffset)
+	if n < len(head) {
+		if err != io.EOF {
+			return false, err
 		}
+		return true, nil
+	}
+	recordSize := int64(binary.LittleEndian.Uint32(head[:]))
+	// Writes start a new segment for a record that doesn't fit, so only
+	// the first record may be larger than the segment.
+	if recordSize < recordHeaderSize+8 ||
+		(sgm.outOffset > int64(headerSize) && recordSize > size-sgm.outOffset+sgm.maxSize) {
+		return false, nil
+	}
+	version := binary.LittleEndian.Uint64(head[9:])
+
+	in := bufio.NewReaderSize(io.NewSectionReader(file, sgm.outOffset+1, size-sgm.outOffset-1), bufSize)
+	var window [recordHeaderSize]byte
+	if _, err := io.ReadFull(in, window[:]); err != nil {
+		return true, nil
+	}
+	for pos := sgm.outOffset + 1; ; pos++ {
+		found, err := recordChain(file, pos, size, window[:], version)
+		if err != nil || found {
+			return false, err
+		}
+		b, err := in.ReadByte()
+		if err != nil {
+			return true, nil
+		}
+		copy(window[:], window[1:])
+		window[len(window)-1] = b
 	}
-	return err
 }
 
-func (sgm *Segment) Get(key string) (string, error) {
-	sgm.mu.Lock()
-	position, ok := sgm.index[key]
-	sgm.mu.Unlock()
-	if !ok {
-		return "", ErrNotFound
+// recordChain tells whether a complete record of another version than the
+// one given starts at pos with the head read from there, and the records
+// following it end right at the end of the file. Operations inside a batch
+// share the version of the batch, so they aren't taken for records.
+func recordChain(file io.ReaderAt, pos, size int64, head []byte, version uint64) (bool, error) {
+	recordSize := int64(binary.LittleEndian.Uint32(head))
+	if recordSize < recordHeaderSize+8 || pos+recordSize > size || binary.LittleEndian.Uint64(head[9:]) == version {
+		return false, nil
 	}
+	crc := crc32.NewIEEE()
+	_, err := io.Copy(crc, io.NewSectionReader(file, pos+8, recordSize-8))
+	if err != nil || crc.Sum32() != binary.LittleEndian.Uint32(head[4:]) {
+		return false, err
+	}
+	var header [4]byte
+	for pos += recordSize; pos < size; pos += recordSize {
+		if _, err := file.ReadAt(header[:], pos); err != nil {
+			return false, nil
+		}
+		recordSize = int64(binary.LittleEndian.Uint32(header[:]))
+		if recordSize < recordHeaderSize+8 || pos+recordSize > size {
+			return false, nil
+		}
+	}
+	return true, nil
+}
 
-	file, err := os.Open(sgm.path)
+// truncateTail drops everything after the last complete record.
+func (sgm *Segment) truncateTail(size int64) error {
+	err := os.Truncate(sgm.path, sgm.outOffset)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer file.Close()
+	log.Printf("Segment %s: dropped %d bytes of a partially written record at offset %d",
+		sgm.path, size-sgm.outOffset, sgm.outOffset)
+	return nil
+}
+
+// indexEntry adds an entry written at pos to the index. Operations of a
+// batch are indexed at their own offsets inside the batch record.
+func (sgm *Segment) indexEntry(e entry, pos recordPos) {
+	if e.version > sgm.maxVersion {
+		sgm.maxVersion = e.version
+	}
+	if e.kind != kindBatch {
+		sgm.index[e.key] = pos
+		return
+	}
+	offset := pos.offset + int64(e.headerSize()+8+len(e.key))
+	for _, op := range e.ops {
+		size := op.encodedSize()
+		sgm.index[op.key] = recordPos{offset, uint32(size)}
+		offset += int64(size)
+	}
+}
 
-	_, err = file.Seek(position, 0)
+func (sgm *Segment) Get(key string) (string, error) {
+	e, err := sgm.getEntry(key)
 	if err != nil {
 		return "", err
 	}
+	if e.kind == kindDelete {
+		return "", errDeleted
+	}
+	return e.value, nil
+}
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+// getEntry returns the latest entry of the key with its value decrypted
+// and decompressed.
+func (sgm *Segment) getEntry(key string) (entry, error) {
+	e, offset, err := sgm.getStored(key)
 	if err != nil {
-		return "", err
+		return e, err
 	}
-	return value, nil
+	e, err = openValue(e, sgm.keyring)
+	if err == errMalformed || err == ErrDecryption {
+		return entry{}, &ErrCorrupted{sgm.path, offset, err}
+	}
+	return e, err
 }
 
-func (sgm Segment) GetAll() (map[string]string, error) {
-	all := make(map[string]string)
-	for key := range sgm.index {
-		val, err := sgm.Get(key)
-		if err != nil {
-			return nil, err
+// getStored returns the latest entry of the key as it is stored together
+// with its offset.
+func (sgm *Segment) getStored(key string) (entry, int64, error) {
+	sgm.mu.Lock()
+	position, ok := sgm.index[key]
+	if !ok {
+		sgm.mu.Unlock()
+		return entry{}, 0, ErrNotFound
+	}
+	file, err := sgm.acquire()
+	sgm.mu.Unlock()
+	if err != nil {
+		return entry{}, 0, err
+	}
+	defer sgm.release()
+
+	e, err := readStored(file, position)
+	if err != nil {
+		if isCorruption(err) {
+			return entry{}, 0, &ErrCorrupted{sgm.path, position.offset, err}
 		}
-		all[key] = val
+		return entry{}, 0, err
 	}
-	return all, nil
+	return e, position.offset, nil
 }
 
-func (sgm *Segment) Relocate(path string) error {
-	err := os.Rename(sgm.path, path)
-	if err != nil {
-		return err
+// readStored reads the whole record at the position and decodes it. The
+// index knows the record size, so it is read with a single call.
+func readStored(file io.ReaderAt, position recordPos) (entry, error) {
+	data := make([]byte, position.size)
+	_, err := file.ReadAt(data, position.offset)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	sgm.path = path
-	return nil
+	var e entry
+	if err == nil {
+		err = e.Decode(data)
+	}
+	return e, err
 }
 
+// HardRemove deletes the segment files. Lookups still reading the segment
+// finish first, the last of them removes the files.
 func (sgm *Segment) HardRemove() error {
-	err := os.Remove(sgm.path)
-	return err
+	sgm.mu.Lock()
+	sgm.removed = true
+	busy := sgm.readers > 0
+	sgm.mu.Unlock()
+	if busy {
+		return nil
+	}
+	return sgm.removeFiles()
+}
+
+func (sgm *Segment) removeFiles() error {
+	sgm.mu.Lock()
+	file := sgm.file
+	sgm.file = nil
+	sgm.mu.Unlock()
+	if file != nil {
+		file.Close()
+	}
+	for _, path := range []string{hintPath(sgm.path), bloomPath(sgm.path)} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(sgm.path)
 }
 
 func (sgm *Segment) initWritingThread(writeChan chan InsertQuery) error {
+	defer close(sgm.writeDone)
 	file, err := os.OpenFile(sgm.path, os.O_APPEND|os.O_WRONLY, 0o600)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+
+	var tick <-chan time.Time
+	if sgm.durability.Mode == SyncInterval {
+		ticker := time.NewTicker(sgm.durability.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	// Writes waiting for the next flush in the SyncInterval mode.
+	var pending []chan error
+	flush := func() error {
+		err := file.Sync()
+		for _, res := range pending {
+			res <- err
+		}
+		pending = nil
+		return err
+	}
+
+	batch := make([]InsertQuery, 0, maxBatchSize)
 	for {
-		query, opened := <-writeChan
-		if !opened {
-			break
+		select {
+		case query, opened := <-writeChan:
+			if !opened {
+				// The segment is sealed now, so its index won't change
+				// anymore.
+				sgm.sealErr = flush()
+				sgm.writeIndexFiles()
+				return nil
+			}
+			batch = append(batch[:0], query)
+			// Coalesce the queries that are already waiting.
+		drain:
+			for len(batch) < maxBatchSize {
+				select {
+				case query, opened := <-writeChan:
+					if !opened {
+						break drain
+					}
+					batch = append(batch, query)
+				default:
+					break drain
+				}
+			}
+			errs, written := sgm.appendBatch(file, batch)
+			if written && sgm.durability.Mode == SyncAlways {
+				err := file.Sync()
+				for i := range errs {
+					if errs[i] == nil {
+						errs[i] = err
+					}
+				}
+			}
+			for i, query := range batch {
+				if errs[i] == nil && sgm.durability.Mode == SyncInterval {
+					pending = append(pending, query.result)
+					continue
+				}
+				query.result <- errs[i]
+			}
+		case <-tick:
+			if len(pending) > 0 {
+				flush()
+			}
+		}
+	}
+}
+
+// appendBatch writes the entries of all queries that fit into the segment
+// with a single write call. Spooled values are copied into the segment
+// after the records written before them. It returns the result of every
+// query and whether anything was written.
+func (sgm *Segment) appendBatch(file *os.File, batch []InsertQuery) ([]error, bool) {
+	errs := make([]error, len(batch))
+	positions := make([]recordPos, len(batch))
+
+	// Only the writing thread changes the offset and the active flag, so
+	// they are read without the lock, which stays free for lookups while
+	// the records are written.
+	var (
+		buf   []byte
+		parts []io.Reader
+	)
+	offset := sgm.outOffset
+	for i, query := range batch {
+		var encoded []byte
+		var value io.Reader
+		size := int64(0)
+		if query.data.spool != nil {
+			encoded, value, errs[i] = query.data.spool.record(query.data)
+			if errs[i] != nil {
+				continue
+			}
+			size = query.data.spool.size
+		} else {
+			encoded = query.data.Encode()
+		}
+		size += int64(len(encoded))
+		// Once an entry doesn't fit, the following ones are rejected too
+		// to keep them ordered. An empty segment takes any entry, so an
+		// entry larger than the segment size gets a segment of its own.
+		if !sgm.active || (offset > int64(headerSize) && offset+size > sgm.maxSize) {
+			sgm.active = false
+			errs[i] = errSegmentFull
+			continue
+		}
+		buf = append(buf, encoded...)
+		if value != nil {
+			parts = append(parts, bytes.NewReader(buf), value)
+			buf = nil
+		}
+		positions[i] = recordPos{offset, uint32(size)}
+		offset += size
+	}
+	if offset == sgm.outOffset {
+		return errs, false
+	}
+
+	var err error
+	if parts == nil {
+		_, err = file.Write(buf)
+	} else {
+		parts = append(parts, bytes.NewReader(buf))
+		_, err = io.Copy(file, io.MultiReader(parts...))
+	}
+	sgm.mu.Lock()
+	defer sgm.mu.Unlock()
+	for i, query := range batch {
+		if errs[i] != nil {
+			continue
 		}
-		data := query.data
-		sgm.mu.Lock()
-		n, err := file.Write(data.Encode())
 		if err != nil {
-			query.result <- err
+			errs[i] = err
+			continue
 		}
-		sgm.index[data.key] = sgm.outOffset
-		sgm.outOffset += int64(n)
-		sgm.active = sgm.outOffset < sgm.maxSize
-		query.result <- nil
-		sgm.mu.Unlock()
+		sgm.indexEntry(query.data, positions[i])
+	}
+	if err != nil {
+		// The file may end with a partial record now, so nothing else
+		// can be appended after it.
+		sgm.active = false
+		return errs, false
+	}
+	sgm.outOffset = offset
+	if sgm.outOffset >= sgm.maxSize {
+		sgm.active = false
+	}
+	return errs, true
+}
+
+// writeIndexFiles saves the index of a sealed segment to its hint file and
+// Bloom filter. Failures are only logged, as recovery rebuilds both.
+func (sgm *Segment) writeIndexFiles() {
+	err := sgm.writeHint()
+	if err != nil {
+		log.Printf("Segment %s: cannot write hint file: %s", sgm.path, err)
+	}
+	err = sgm.buildBloom()
+	if err != nil {
+		log.Printf("Segment %s: cannot write Bloom filter: %s", sgm.path, err)
 	}
-	return nil
 }
 
-func (sgm *Segment) StopWritingThread() {
-	close(sgm.writeChan)
-	sgm.writeChan = nil
+// StopWritingThread seals the segment and waits until its hint file and
+// Bloom filter are written. It returns the error of flushing the segment
+// to disk.
+func (sgm *Segment) StopWritingThread() error {
+	sgm.writeMu.Lock()
+	if sgm.writeChan != nil {
+		close(sgm.writeChan)
+		sgm.writeChan = nil
+	}
+	sgm.writeMu.Unlock()
+	if sgm.writeDone == nil {
+		return nil
+	}
+	<-sgm.writeDone
+	return sgm.sealErr
 }
@@ -1,6 +1,8 @@
 package datastore
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -9,12 +11,14 @@ import (
 )
 
 // We want to crate 2 segments - minimum number before segments start to merge.
-// To do this, we set the segment to be 1 KB and write 2 KB of entries.
+// To do this, we set the segment to be 1 KB and write as many entries as
+// two segments can hold after their file headers.
 // Our keys and values both have length of 10 bytes. Together with an
-// entry header it should be 32 bytes per entry.
+// entry header (size, checksum, kind, version and flags) it should be 46
+// bytes per entry.
 const KB = 1024
-const ENTRY = 32
-const ENTRY_NUMBER = 2 * KB / ENTRY
+const ENTRY = 46
+const ENTRY_NUMBER = 2 * ((KB - headerSize) / ENTRY)
 
 // Craft 10 bytes wide string
 func craft_string(i int) string {
@@ -66,3 +70,311 @@ func Test_Segment(t *testing.T) {
 		return nil
 	})
 }
+
+func TestSegment_Corruption(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-segment-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	sgm := db.segments[len(db.segments)-1]
+	data, err := ioutil.ReadFile(sgm.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := sgm.index[pairs[1][0]].offset
+	data[offset+recordHeaderSize+4] ^= 0xff
+	if err := ioutil.WriteFile(sgm.path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Without the hint written on close the segment is read on recovery.
+	os.Remove(sgm.path + hintSuffix)
+
+	_, err = NewDb(dir, segmentSize)
+	var corrupted *ErrCorrupted
+	if !errors.As(err, &corrupted) {
+		t.Fatalf("Expected ErrCorrupted, got %v", err)
+	}
+	if corrupted.Segment != sgm.path || corrupted.Offset != offset {
+		t.Errorf("Bad corruption location %s:%d, expected %s:%d", corrupted.Segment, corrupted.Offset, sgm.path, offset)
+	}
+}
+
+func TestSegment_LegacyUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-segment-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var legacy []byte
+	// Deleted keys used to be stored with a "null" value.
+	for _, pair := range append(pairs, []string{"gone", "null"}) {
+		kl, vl := len(pair[0]), len(pair[1])
+		record := make([]byte, kl+vl+12)
+		binary.LittleEndian.PutUint32(record, uint32(len(record)))
+		binary.LittleEndian.PutUint32(record[4:], uint32(kl))
+		copy(record[8:], pair[0])
+		binary.LittleEndian.PutUint32(record[kl+8:], uint32(vl))
+		copy(record[kl+12:], pair[1])
+		legacy = append(legacy, record...)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "1"), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, pair := range pairs {
+		value, err := db.Get(pair[0])
+		if err != nil {
+			t.Errorf("Cannot get %s: %s", pair[0], err)
+		}
+		if value != pair[1] {
+			t.Errorf("Bad value returned expected %s, got %s", pair[1], value)
+		}
+	}
+	if _, err := db.Get("gone"); err != ErrNotFound {
+		t.Errorf("Expected legacy deleted key to be not found, got %v", err)
+	}
+	format, err := segmentFormat(filepath.Join(dir, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != formatVersion {
+		t.Errorf("Segment was not upgraded, format is %d", format)
+	}
+}
+
+func TestSegment_TornTail(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-segment-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	sgm := db.segments[len(db.segments)-1]
+	torn := (&entry{key: "torn", value: "value"}).Encode()
+	f, err := os.OpenFile(sgm.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(torn[:len(torn)/2])
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := NewDb(dir, segmentSize, WithStrictRecovery(true))
+		var corrupted *ErrCorrupted
+		if !errors.As(err, &corrupted) {
+			t.Fatalf("Expected ErrCorrupted, got %v", err)
+		}
+		if corrupted.Offset != sgm.outOffset {
+			t.Errorf("Bad corruption offset %d, expected %d", corrupted.Offset, sgm.outOffset)
+		}
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		db, err := NewDb(dir, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for _, pair := range pairs {
+			value, err := db.Get(pair[0])
+			if err != nil || value != pair[1] {
+				t.Errorf("Bad value of %s: %s, %v", pair[0], value, err)
+			}
+		}
+		info, err := os.Stat(sgm.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != sgm.outOffset {
+			t.Errorf("Segment size is %d, expected it to be truncated to %d", info.Size(), sgm.outOffset)
+		}
+	})
+}
+
+func TestSegment_CorruptedSize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		key  string
+		// Byte of the size field and the bit flipped in it.
+		at  int64
+		bit byte
+	}{
+		{"first record", "key1", 3, 0x10},
+		{"middle record", "key2", 1, 0x04},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir(".", "test-segment-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewDb(dir, segmentSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pair := range append(pairs, []string{"key4", "value4"}) {
+				if err := db.Put(pair[0], pair[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Close()
+
+			sgm := db.segments[len(db.segments)-1]
+			offset := sgm.index[tc.key].offset
+			data, err := ioutil.ReadFile(sgm.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[offset+tc.at] ^= tc.bit
+			if err := ioutil.WriteFile(sgm.path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(sgm.path + hintSuffix)
+
+			for _, strict := range []bool{false, true} {
+				_, err = NewDb(dir, segmentSize, WithStrictRecovery(strict))
+				var corrupted *ErrCorrupted
+				if !errors.As(err, &corrupted) {
+					t.Fatalf("Expected ErrCorrupted, got %v", err)
+				}
+				if corrupted.Offset != offset {
+					t.Errorf("Bad corruption offset %d, expected %d", corrupted.Offset, offset)
+				}
+			}
+			info, err := os.Stat(sgm.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(len(data)) {
+				t.Errorf("Corrupted segment was truncated to %d bytes of %d", info.Size(), len(data))
+			}
+		})
+	}
+}
+
+func TestSegment_TornBatch(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-segment-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The batch is cut right after its first operation, which is a
+	// complete record of its own.
+	ops := []entry{
+		{key: "first", value: "value", version: 10},
+		{key: "second", value: "value", version: 10},
+	}
+	batch := newBatchEntry(ops).withVersion(10)
+	encoded := batch.Encode()
+	cut := batch.headerSize() + 8 + ops[0].encodedSize()
+	sgm := db.segments[len(db.segments)-1]
+	f, err := os.OpenFile(sgm.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(encoded[:cut])
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Bad value: %s, %v", value, err)
+	}
+	if _, err := db.Get("first"); err != ErrNotFound {
+		t.Errorf("Operation of a torn batch is recovered: %v", err)
+	}
+}
+
+func TestSegment_RemoveWhileReading(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-segment-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "1")
+	data := append(fileHeader(), (&entry{key: "key", value: "value"}).Encode()...)
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sgm, err := NewSegment(path, segmentSize, false, Durability{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sgm.recover(false); err != nil {
+		t.Fatal(err)
+	}
+
+	sgm.mu.Lock()
+	_, err = sgm.acquire()
+	sgm.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sgm.HardRemove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Segment removed while being read: %s", err)
+	}
+	if _, err := sgm.getEntry("key"); err != errSegmentRemoved {
+		t.Errorf("Expected lookups of a removed segment to fail, got %v", err)
+	}
+
+	sgm.release()
+	for _, path := range []string{path, hintPath(path), bloomPath(path)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("File %s was not removed after the last read", path)
+		}
+	}
+}
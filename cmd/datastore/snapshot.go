@@ -0,0 +1,167 @@
+package datastore
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Snapshot writes a tar archive of the database as it is at the moment of
+// the call: the live segments followed by their manifest. Writes and
+// compaction go on meanwhile, entries written after the call aren't in the
+// archive. Hint files and Bloom filters are left out, recovery rebuilds
+// them.
+func (db *Db) Snapshot(w io.Writer) error {
+	type part struct {
+		sgm  *Segment
+		file *os.File
+		size int64
+	}
+	var (
+		parts []part
+		err   error
+	)
+	// The segments are held as readers, so compaction can't remove their
+	// files before they are copied. The active segment is copied up to the
+	// end of its last complete write.
+	db.mu.Lock()
+	for _, sgm := range db.segments {
+		sgm.mu.Lock()
+		var file *os.File
+		file, err = sgm.acquire()
+		size := sgm.outOffset
+		sgm.mu.Unlock()
+		if err != nil {
+			break
+		}
+		parts = append(parts, part{sgm, file, size})
+	}
+	db.mu.Unlock()
+	// Read after the segment sizes, so it covers every copied entry.
+	version := db.latestVersion()
+	defer func() {
+		for _, p := range parts {
+			p.sgm.release()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	names := make([]string, len(parts))
+	for i, p := range parts {
+		names[i] = filepath.Base(p.sgm.path)
+		err := tw.WriteHeader(&tar.Header{
+			Name:    names[i],
+			Mode:    0o600,
+			Size:    p.size,
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, io.NewSectionReader(p.file, 0, p.size))
+		if err != nil {
+			return err
+		}
+	}
+	data := encodeManifest(manifest{names, version})
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0o600,
+		Size:    int64(len(data)),
+		ModTime: now,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Restore unpacks an archive written by Snapshot into dir, which must be
+// empty or not exist yet. The manifest is written last, so an interrupted
+// restore isn't mistaken for a database.
+func Restore(r io.Reader, dir string) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("directory %s is not empty", dir)
+	}
+
+	var manifest []byte
+	restored := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Name == manifestName {
+			manifest, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// Only segments named by their creation time are expected, which
+		// also keeps the files inside dir.
+		_, err = strconv.ParseUint(header.Name, 10, 64)
+		if err != nil || header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected file %q in the archive", header.Name)
+		}
+		err = restoreFile(filepath.Join(dir, header.Name), tr)
+		if err != nil {
+			return err
+		}
+		restored[header.Name] = true
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("archive has no manifest")
+	}
+	m, err := decodeManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("archive manifest: %w", err)
+	}
+	for _, name := range m.segments {
+		if !restored[name] {
+			return fmt.Errorf("segment %s is missing from the archive", name)
+		}
+	}
+	return replaceFile(dir, manifestName, manifest)
+}
+
+func restoreFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
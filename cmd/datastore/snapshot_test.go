@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-snapshot-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbDir := filepath.Join(dir, "db")
+	if err := os.Mkdir(dbDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDb(dbDir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writes and compactions go on while the snapshot is taken.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	written := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ; ; written++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.Put(fmt.Sprintf("late%d", written), "value"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var archive bytes.Buffer
+	err = db.Snapshot(&archive)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoredDir := filepath.Join(dir, "restored")
+	if err := Restore(bytes.NewReader(archive.Bytes()), restoredDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewDb(restoredDir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if value, err := restored.Get(key); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Bad value of %s: %q, %v", key, value, err)
+		}
+	}
+	// The concurrent writes are sequential, so a point-in-time snapshot
+	// holds a prefix of them.
+	missing := -1
+	for i := 0; i < written; i++ {
+		_, err := restored.Get(fmt.Sprintf("late%d", i))
+		if err == nil && missing >= 0 {
+			t.Fatalf("Snapshot has late%d but not late%d", i, missing)
+		}
+		if err == ErrNotFound && missing < 0 {
+			missing = i
+		}
+	}
+
+	if err := Restore(bytes.NewReader(archive.Bytes()), restoredDir); err == nil {
+		t.Error("Expected restore into a non-empty directory to fail")
+	}
+}
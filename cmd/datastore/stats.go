@@ -0,0 +1,46 @@
+package datastore
+
+import "sync/atomic"
+
+// Stats describes the state of the database.
+type Stats struct {
+	Segments int `json:"segments"`
+	// Memory taken by the Bloom filters of sealed segments in bytes.
+	BloomBytes int64 `json:"bloomBytes"`
+	// Lookups of keys missing from a segment that its Bloom filter rejected
+	// or let through.
+	BloomNegatives      uint64 `json:"bloomNegatives"`
+	BloomFalsePositives uint64 `json:"bloomFalsePositives"`
+	// Share of the lookups of missing keys the Bloom filters let through.
+	BloomFalsePositiveRate float64 `json:"bloomFalsePositiveRate"`
+	// Lookups answered by the value cache and the ones that missed it, both
+	// zero when caching is disabled.
+	CacheHits   uint64 `json:"cacheHits"`
+	CacheMisses uint64 `json:"cacheMisses"`
+	// Memory taken by cached values in bytes.
+	CacheBytes int64 `json:"cacheBytes"`
+}
+
+func (db *Db) Stats() Stats {
+	db.mu.Lock()
+	sgms := db.segments
+	db.mu.Unlock()
+
+	stats := Stats{
+		Segments:            len(sgms),
+		BloomNegatives:      atomic.LoadUint64(&db.bloomNegatives),
+		BloomFalsePositives: atomic.LoadUint64(&db.bloomFalsePositives),
+	}
+	for _, sgm := range sgms {
+		sgm.mu.Lock()
+		if sgm.bloom != nil {
+			stats.BloomBytes += sgm.bloom.size()
+		}
+		sgm.mu.Unlock()
+	}
+	stats.CacheHits, stats.CacheMisses, stats.CacheBytes = db.cache.stats()
+	if lookups := stats.BloomNegatives + stats.BloomFalsePositives; lookups > 0 {
+		stats.BloomFalsePositiveRate = float64(stats.BloomFalsePositives) / float64(lookups)
+	}
+	return stats
+}
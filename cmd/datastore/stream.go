@@ -0,0 +1,407 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+// Values read by PutStream up to streamThreshold bytes long are kept in
+// memory and written like values of Put, longer ones are spooled to a
+// temporary file first.
+const streamThreshold = 64 * 1024
+
+const spoolSuffix = ".spool"
+
+// maxRecordSize is the longest record its 4 byte size field can hold.
+const maxRecordSize = math.MaxUint32
+
+// spooledValue is a value stored in a temporary file of the database
+// directory, so it is appended to a segment without being held in memory.
+type spooledValue struct {
+	file *os.File
+	size int64
+}
+
+// spool copies the value read from r to a temporary file.
+func (db *Db) spool(r io.Reader) (*spooledValue, error) {
+	f, err := ioutil.TempFile(db.dirPath, "value-*"+spoolSuffix)
+	if err != nil {
+		return nil, err
+	}
+	v := &spooledValue{file: f}
+	v.size, err = io.Copy(f, r)
+	if err != nil {
+		v.remove()
+		return nil, err
+	}
+	return v, nil
+}
+
+// compressSpooled compresses the spooled value with the codec of the
+// database when that saves space. It returns the value to write and its codec.
+func (db *Db) compressSpooled(v *spooledValue) (*spooledValue, Codec, error) {
+	c := db.compression
+	if c.Codec == NoCompression || v.size < int64(c.Threshold) {
+		return v, NoCompression, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := c.Codec.compressor(pw)
+		if err == nil {
+			_, err = io.Copy(w, io.NewSectionReader(v.file, 0, v.size))
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	compressed, err := db.spool(pr)
+	pr.Close()
+	if err != nil {
+		return nil, NoCompression, err
+	}
+	if compressed.size >= v.size {
+		compressed.remove()
+		return v, NoCompression, nil
+	}
+	v.remove()
+	return compressed, c.Codec, nil
+}
+
+func (v *spooledValue) remove() {
+	v.file.Close()
+	os.Remove(v.file.Name())
+}
+
+// record returns the head of the record of the entry, with the checksum
+// computed over the spooled value, and a reader of the value to follow it.
+func (v *spooledValue) record(e entry) ([]byte, io.Reader, error) {
+	head := e.encodeHead(v.size)
+	if int64(len(head))+v.size > maxRecordSize {
+		return nil, nil, fmt.Errorf("record of %s is longer than %d bytes", e.key, int64(maxRecordSize))
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(head[8:])
+	_, err := io.Copy(crc, io.NewSectionReader(v.file, 0, v.size))
+	if err != nil {
+		return nil, nil, err
+	}
+	binary.LittleEndian.PutUint32(head[4:], crc.Sum32())
+	return head, io.NewSectionReader(v.file, 0, v.size), nil
+}
+
+// newStreamEntry builds a put entry of the value read from r. The spool of
+// the returned entry has to be removed once it is written. Values of
+// encrypted databases are read into memory, as they are sealed in a single
+// piece.
+func (db *Db) newStreamEntry(key string, r io.Reader, opts []WriteOption) (entry, error) {
+	if db.readOnly {
+		return entry{}, ErrReadOnly
+	}
+	if err := db.checkKey(key); err != nil {
+		return entry{}, err
+	}
+	// Reading stops at the first byte over the limit.
+	r = io.LimitReader(r, db.limits.MaxValueSize+1)
+	var head bytes.Buffer
+	_, err := io.CopyN(&head, r, streamThreshold+1)
+	if err == io.EOF || (err == nil && db.keyring != nil) {
+		_, err = io.Copy(&head, r)
+		if err != nil {
+			return entry{}, err
+		}
+		return db.newPutEntry(key, head.String(), opts)
+	}
+	if err != nil {
+		return entry{}, err
+	}
+
+	e := entry{key: key, kind: kindPut}
+	for _, opt := range opts {
+		opt(&e)
+	}
+	if len(e.contentType) > maxContentTypeSize {
+		return entry{}, fmt.Errorf("content type is longer than %d bytes", maxContentTypeSize)
+	}
+	v, err := db.spool(io.MultiReader(&head, r))
+	if err != nil {
+		return entry{}, err
+	}
+	if err := db.checkValue(v.size); err != nil {
+		v.remove()
+		return entry{}, err
+	}
+	e.spool, e.codec, err = db.compressSpooled(v)
+	if err != nil {
+		v.remove()
+		return entry{}, err
+	}
+	return e, nil
+}
+
+func (e *entry) removeSpool() {
+	if e.spool != nil {
+		e.spool.remove()
+	}
+}
+
+// PutStream stores the value read from r until EOF and returns the new
+// version of the key. Long values are spooled to a temporary file in the
+// database directory instead of memory.
+func (db *Db) PutStream(key string, r io.Reader, opts ...WriteOption) (uint64, error) {
+	if err := checkUserKey(key); err != nil {
+		return 0, err
+	}
+	return db.putStream(key, r, opts)
+}
+
+func (db *Db) putStream(key string, r io.Reader, opts []WriteOption) (uint64, error) {
+	e, err := db.newStreamEntry(key, r, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer e.removeSpool()
+	db.condMu.RLock()
+	defer db.condMu.RUnlock()
+	return db.write(e.withVersion)
+}
+
+// CompareAndSwapStream is CompareAndSwap with the value read from r like
+// PutStream does. The value is read before the version is compared.
+func (db *Db) CompareAndSwapStream(key string, expectedVersion uint64, r io.Reader, opts ...WriteOption) (uint64, error) {
+	if err := checkUserKey(key); err != nil {
+		return 0, err
+	}
+	return db.compareAndSwapStream(key, expectedVersion, r, opts)
+}
+
+func (db *Db) compareAndSwapStream(key string, expectedVersion uint64, r io.Reader, opts []WriteOption) (uint64, error) {
+	return db.putStreamIf(key, VersionIn(expectedVersion), r, opts)
+}
+
+// PutIfAbsentStream is PutIfAbsent with the value read from r like
+// PutStream does.
+func (db *Db) PutIfAbsentStream(key string, r io.Reader, opts ...WriteOption) (uint64, error) {
+	if err := checkUserKey(key); err != nil {
+		return 0, err
+	}
+	return db.putIfAbsentStream(key, r, opts)
+}
+
+func (db *Db) putIfAbsentStream(key string, r io.Reader, opts []WriteOption) (uint64, error) {
+	return db.putStreamIf(key, absent, r, opts)
+}
+
+// PutStreamIf stores the value read from r like PutStream does, but only
+// if the condition holds. The value is read before the condition is
+// checked.
+func (db *Db) PutStreamIf(key string, cond Condition, r io.Reader, opts ...WriteOption) (uint64, error) {
+	if err := checkUserKey(key); err != nil {
+		return 0, err
+	}
+	return db.putStreamIf(key, cond, r, opts)
+}
+
+func (db *Db) putStreamIf(key string, cond Condition, r io.Reader, opts []WriteOption) (uint64, error) {
+	e, err := db.newStreamEntry(key, r, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer e.removeSpool()
+	return db.writeIf(e, cond)
+}
+
+// ValueReader reads a value straight from its segment file. The segment
+// isn't removed by compaction until the reader is closed.
+type ValueReader struct {
+	Version     uint64
+	ContentType string
+	// Size is the length of the value, -1 for compressed values whose
+	// length is only known once they are read.
+	Size int64
+
+	r       io.Reader
+	release func()
+}
+
+func (v *ValueReader) Read(p []byte) (int, error) {
+	return v.r.Read(p)
+}
+
+// Close releases the segment the value is read from.
+func (v *ValueReader) Close() error {
+	if v.release != nil {
+		v.release()
+		v.release = nil
+	}
+	return nil
+}
+
+// GetStream returns a reader of the value of the key. The checksum of the
+// record is verified before it is returned, so reading the value only
+// fails on I/O errors.
+func (db *Db) GetStream(key string) (*ValueReader, error) {
+	if err := checkUserKey(key); err != nil {
+		return nil, err
+	}
+	return db.getStream(key)
+}
+
+func (db *Db) getStream(key string) (*ValueReader, error) {
+	if e, ok := db.cache.get(key); ok {
+		return newValueReader(e), nil
+	}
+	var opened *ValueReader
+	_, err := db.lookupWith(key, func(sgm *Segment, key string) (entry, error) {
+		e, v, err := sgm.getStream(key)
+		opened = v
+		return e, err
+	})
+	if err != nil {
+		if opened != nil {
+			opened.Close()
+		}
+		return nil, err
+	}
+	return opened, nil
+}
+
+func newValueReader(e entry) *ValueReader {
+	return &ValueReader{
+		Version:     e.version,
+		ContentType: e.contentType,
+		Size:        int64(len(e.value)),
+		r:           strings.NewReader(e.value),
+	}
+}
+
+// getStream returns the latest entry of the key without its value and,
+// for put entries, a reader of the value. The reader holds the segment
+// until it is closed.
+func (sgm *Segment) getStream(key string) (entry, *ValueReader, error) {
+	sgm.mu.Lock()
+	position, ok := sgm.index[key]
+	if !ok {
+		sgm.mu.Unlock()
+		return entry{}, nil, ErrNotFound
+	}
+	file, err := sgm.acquire()
+	sgm.mu.Unlock()
+	if err != nil {
+		return entry{}, nil, err
+	}
+
+	e, start, err := readRecordHead(file, position)
+	if err == nil && e.kind != kindPut {
+		sgm.release()
+		return e, nil, nil
+	}
+	var v *ValueReader
+	if err == nil {
+		value := io.NewSectionReader(file, position.offset+int64(start), int64(position.size)-int64(start))
+		v, err = sgm.openStream(e, value)
+	}
+	if err != nil {
+		sgm.release()
+		if isCorruption(err) || err == ErrDecryption {
+			return entry{}, nil, &ErrCorrupted{sgm.path, position.offset, err}
+		}
+		return entry{}, nil, err
+	}
+	v.release = sgm.release
+	return e, v, nil
+}
+
+// openStream returns a reader of the stored value of the entry. Encrypted
+// values are read and decrypted in memory.
+func (sgm *Segment) openStream(e entry, value *io.SectionReader) (*ValueReader, error) {
+	if e.keyID != 0 {
+		data, err := ioutil.ReadAll(value)
+		if err != nil {
+			return nil, err
+		}
+		e.value = string(data)
+		e, err = openValue(e, sgm.keyring)
+		if err != nil {
+			return nil, err
+		}
+		return newValueReader(e), nil
+	}
+	r, err := e.codec.decompressor(value)
+	if err != nil {
+		return nil, err
+	}
+	v := &ValueReader{
+		Version:     e.version,
+		ContentType: e.contentType,
+		Size:        value.Size(),
+		r:           r,
+	}
+	if e.codec != NoCompression {
+		v.Size = -1
+	}
+	return v, nil
+}
+
+// readRecordHead decodes the record at the position up to its value and
+// returns the offset of the value in it. The whole record is read through
+// to verify its checksum, but only its head is kept in memory.
+func readRecordHead(file io.ReaderAt, position recordPos) (entry, int, error) {
+	size := int(position.size)
+	prefixSize := size
+	if prefixSize > maxFieldsSize {
+		prefixSize = maxFieldsSize
+	}
+	prefix := make([]byte, prefixSize)
+	_, err := file.ReadAt(prefix, position.offset)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return entry{}, 0, err
+	}
+	var e entry
+	h, err := e.decodeFields(prefix)
+	if err != nil {
+		return entry{}, 0, err
+	}
+	if int(binary.LittleEndian.Uint32(prefix)) != size {
+		return entry{}, 0, errMalformed
+	}
+	headSize := h + int(binary.LittleEndian.Uint32(prefix[h:])) + 8
+	if headSize > size {
+		return entry{}, 0, errMalformed
+	}
+	head := prefix
+	if headSize > len(prefix) {
+		head = make([]byte, headSize)
+		_, err = file.ReadAt(head, position.offset)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return entry{}, 0, err
+		}
+	}
+	start, err := e.decodeHead(head, size)
+	if err != nil {
+		return entry{}, 0, err
+	}
+
+	crc := crc32.NewIEEE()
+	_, err = io.Copy(crc, io.NewSectionReader(file, position.offset+8, int64(size)-8))
+	if err != nil {
+		return entry{}, 0, err
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(prefix[4:]) {
+		return entry{}, 0, errChecksum
+	}
+	return e, start, nil
+}
@@ -0,0 +1,211 @@
+package datastore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// largeValue returns a value several times larger than the buffers used to
+// read segments, half of it random so it doesn't compress away.
+func largeValue(size int) []byte {
+	value := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(value[:size/2])
+	for i := size / 2; i < size; i++ {
+		value[i] = byte('a' + i%26)
+	}
+	return value
+}
+
+func TestDb_Stream(t *testing.T) {
+	keys, err := NewKeyring(map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"plain", nil},
+		{"compressed", []Option{WithCompression(Compression{Codec: Flate})}},
+		{"encrypted", []Option{WithEncryption(keys)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir(".", "test-stream-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewDb(dir, 1024*1024, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.stopCompactor()
+
+			large := largeValue(3*1024*1024 + 7)
+			if _, err := db.PutStream("large", bytes.NewReader(large), WithContentType("application/octet-stream")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.PutStream("small", strings.NewReader("value")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.PutIfAbsentStream("large", bytes.NewReader(large)); err != ErrVersionMismatch {
+				t.Errorf("PutIfAbsentStream of an existing key: got %v", err)
+			}
+
+			check := func() {
+				t.Helper()
+				v, err := db.GetStream("large")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer v.Close()
+				data, err := ioutil.ReadAll(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, large) {
+					t.Errorf("Large value read back with %d bytes of %d", len(data), len(large))
+				}
+				if v.ContentType != "application/octet-stream" {
+					t.Errorf("Bad content type %q", v.ContentType)
+				}
+				if v.Size != -1 && v.Size != int64(len(large)) {
+					t.Errorf("Bad size %d", v.Size)
+				}
+				if value, err := db.GetBytes("large"); err != nil || !bytes.Equal(value, large) {
+					t.Errorf("Large value isn't read back by GetBytes: %v", err)
+				}
+				if value, err := db.Get("small"); err != nil || value != "value" {
+					t.Errorf("Bad small value: %q, %v", value, err)
+				}
+			}
+			check()
+			// Values of encrypted databases are opened in memory.
+			if tc.name != "encrypted" {
+				if allocated := streamAllocated(t, db, "large"); allocated > uint64(len(large)/4) {
+					t.Errorf("Streaming a value of %d bytes allocated %d bytes", len(large), allocated)
+				}
+			}
+
+			// No hint files, so recovery reads the large records from the
+			// segments.
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			hints, _ := filepath.Glob(filepath.Join(dir, "*"+hintSuffix))
+			for _, hint := range hints {
+				os.Remove(hint)
+			}
+			recovered := allocated(func() {
+				db, err = NewDb(dir, 1024*1024, tc.opts...)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			db.stopCompactor()
+			check()
+
+			compacted := allocated(func() {
+				err = db.Compact()
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			check()
+			// Records are copied without reading their values into memory.
+			if recovered > uint64(len(large)/4) || compacted > uint64(len(large)/4) {
+				t.Errorf("A value of %d bytes allocated %d bytes on recovery and %d bytes on compaction",
+					len(large), recovered, compacted)
+			}
+
+			if spools, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix)); len(spools) > 0 {
+				t.Errorf("Spooled values are left: %v", spools)
+			}
+		})
+	}
+}
+
+// allocated returns how many bytes the function allocates.
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// streamAllocated returns how many bytes reading the value of the key
+// through GetStream allocates.
+func streamAllocated(t *testing.T, db *Db, key string) uint64 {
+	t.Helper()
+	var err error
+	n := allocated(func() {
+		var v *ValueReader
+		v, err = db.GetStream(key)
+		if err != nil {
+			return
+		}
+		_, err = io.Copy(ioutil.Discard, v)
+		v.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDb_StreamDeleted(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "test-stream-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.GetStream("missing"); err != ErrNotFound {
+		t.Errorf("Missing key: got %v", err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetStream("key"); err != ErrNotFound {
+		t.Errorf("Deleted key: got %v", err)
+	}
+}
+
+func TestReadRecordHead_Checksum(t *testing.T) {
+	e := entry{key: "key", kind: kindPut, value: string(largeValue(10000)), contentType: "text/plain"}
+	data := e.Encode()
+	position := recordPos{0, uint32(len(data))}
+
+	decoded, start, err := readRecordHead(bytes.NewReader(data), position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.key != "key" || decoded.contentType != "text/plain" || data[start] != e.value[0] {
+		t.Errorf("Bad head decoded: %+v at %d", decoded, start)
+	}
+
+	data[len(data)-1] ^= 0xff
+	if _, _, err := readRecordHead(bytes.NewReader(data), position); err != errChecksum {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+}
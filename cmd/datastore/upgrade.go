@@ -0,0 +1,236 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+const upgradeSuffix = ".upgrade"
+
+// segmentFormat returns the format version of the segment file. Files
+// without a header are reported as version 0.
+func segmentFormat(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if n < headerSize || !bytes.Equal(header[:len(segmentMagic)], []byte(segmentMagic)) {
+		return 0, nil
+	}
+	return int(header[len(segmentMagic)]), nil
+}
+
+// decodeLegacy decodes a record of the headerless format:
+// size | key size | key | value size | value.
+func decodeLegacy(input []byte) (entry, error) {
+	if len(input) < 12 || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return entry{}, errMalformed
+	}
+	e, err := decodeKeyValue(input[4:])
+	e.version = upgradedVersion
+	return e, err
+}
+
+// decodeV1 decodes a record of the first checksummed format:
+// size | crc | key size | key | value size | value.
+func decodeV1(input []byte) (entry, error) {
+	if len(input) < 16 || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return entry{}, errMalformed
+	}
+	if crc32.ChecksumIEEE(input[8:]) != binary.LittleEndian.Uint32(input[4:]) {
+		return entry{}, errChecksum
+	}
+	e, err := decodeKeyValue(input[8:])
+	e.version = upgradedVersion
+	return e, err
+}
+
+// decodeV2 decodes a record of the format that added the record kind:
+// size | crc | kind | key size | key | value size | value.
+func decodeV2(input []byte) (entry, error) {
+	if len(input) < 17 || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return entry{}, errMalformed
+	}
+	if crc32.ChecksumIEEE(input[8:]) != binary.LittleEndian.Uint32(input[4:]) {
+		return entry{}, errChecksum
+	}
+	e, err := decodeKeyValue(input[9:])
+	e.kind = input[8]
+	e.version = upgradedVersion
+	if err != nil {
+		return e, err
+	}
+	return upgradeBatch(e, decodeV2)
+}
+
+// decodeV3 decodes a record of the format that added key versions:
+// size | crc | kind | version | key size | key | value size | value.
+func decodeV3(input []byte) (entry, error) {
+	if len(input) < 25 || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return entry{}, errMalformed
+	}
+	if crc32.ChecksumIEEE(input[8:]) != binary.LittleEndian.Uint32(input[4:]) {
+		return entry{}, errChecksum
+	}
+	e, err := decodeKeyValue(input[17:])
+	e.kind = input[8]
+	e.version = binary.LittleEndian.Uint64(input[9:])
+	if err != nil {
+		return e, err
+	}
+	return upgradeBatch(e, decodeV3)
+}
+
+// upgradeBatch re-encodes the operations of a batch record of an older
+// format in the current one.
+func upgradeBatch(e entry, decode func([]byte) (entry, error)) (entry, error) {
+	if e.kind != kindBatch {
+		return e, nil
+	}
+	var ops []entry
+	data := []byte(e.value)
+	for pos := 0; pos < len(data); {
+		if pos+4 > len(data) {
+			return entry{}, errMalformed
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos:]))
+		if size <= 0 || pos+size > len(data) {
+			return entry{}, errMalformed
+		}
+		op, err := decode(data[pos : pos+size])
+		if err != nil {
+			return entry{}, err
+		}
+		ops = append(ops, op)
+		pos += size
+	}
+	return newBatchEntry(ops).withVersion(e.version), nil
+}
+
+func decodeKeyValue(input []byte) (entry, error) {
+	var e entry
+	kl := int(binary.LittleEndian.Uint32(input))
+	if kl+8 > len(input) {
+		return e, errMalformed
+	}
+	vl := int(binary.LittleEndian.Uint32(input[kl+4:]))
+	if kl+8+vl != len(input) {
+		return e, errMalformed
+	}
+	e.key = string(input[4 : kl+4])
+	e.value = string(input[kl+8:])
+	return e, nil
+}
+
+// deletedValue marked deleted keys before records got a kind.
+const deletedValue = "null"
+
+// upgradedVersion is given to entries written before keys had versions.
+const upgradedVersion = 1
+
+// upgradeSegment rewrites a segment of an older format in the current one.
+// The new file is written next to the old one and renamed over it, so a
+// crash leaves either the old or the new version in place. A partially
+// written record at the end of the file is dropped unless strict is set.
+func upgradeSegment(path string, format int, strict bool) error {
+	var decode func([]byte) (entry, error)
+	switch format {
+	case 0:
+		decode = decodeLegacy
+	case 1:
+		decode = decodeV1
+	case 2:
+		decode = decodeV2
+	case 3:
+		decode = decodeV3
+	default:
+		return fmt.Errorf("segment %s has unsupported format version %d", path, format)
+	}
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	tmpPath := path + upgradeSuffix
+	output, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer output.Close()
+
+	in := bufio.NewReaderSize(input, bufSize)
+	out := bufio.NewWriterSize(output, bufSize)
+	_, err = out.Write(fileHeader())
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if format > 0 {
+		offset = int64(headerSize)
+		_, err = in.Discard(headerSize)
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		data, err := readRecord(in)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF && !strict {
+			log.Printf("Segment %s: dropped a partially written record at offset %d", path, offset)
+			break
+		}
+		if err != nil {
+			if isCorruption(err) {
+				return &ErrCorrupted{path, offset, err}
+			}
+			return err
+		}
+		e, err := decode(data)
+		if err != nil {
+			return &ErrCorrupted{path, offset, err}
+		}
+		if format < 2 && e.value == deletedValue {
+			e = entry{key: e.key, kind: kindDelete, version: e.version}
+		}
+		_, err = out.Write(e.Encode())
+		if err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+
+	err = out.Flush()
+	if err != nil {
+		return err
+	}
+	err = output.Sync()
+	if err != nil {
+		return err
+	}
+	// Offsets of the old hint file and the size recorded by the Bloom
+	// filter don't match the upgraded segment.
+	for _, sidecar := range []string{hintPath(path), bloomPath(path)} {
+		err = os.Remove(sidecar)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const jsonType = "application/json"
+const binaryType = "application/octet-stream"
+const formType = "application/x-www-form-urlencoded"
+
+// isJSON tells whether a request body of the content type is a JSON
+// document. Requests without a content type or with the form type curl
+// sends by default are taken for JSON, as they were before raw values were
+// accepted.
+func isJSON(contentType string) (bool, error) {
+	if contentType == "" {
+		return true, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false, err
+	}
+	return mediaType == jsonType || mediaType == formType, nil
+}
+
+// negotiate picks the offered media type the Accept header prefers. Offers
+// go from the most to the least preferred by the server, which decides
+// ties and requests without an Accept header. It reports false when the
+// client accepts none of them.
+func negotiate(accept string, offers ...string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q := acceptQuality(accept, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// acceptQuality returns the quality the Accept header gives to the media
+// type, taken from the most specific range that matches it.
+func acceptQuality(accept, offer string) float64 {
+	offerType, _, err := mime.ParseMediaType(offer)
+	if err != nil {
+		return 0
+	}
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		s := matchRange(mediaRange, offerType)
+		if s <= specificity {
+			continue
+		}
+		rangeQ := 1.0
+		if v, ok := params["q"]; ok {
+			rangeQ, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		q, specificity = rangeQ, s
+	}
+	return q
+}
+
+// matchRange returns how specific the media range matching the type is:
+// 2 for the type itself, 1 for type/* and 0 for */*, -1 if it doesn't
+// match.
+func matchRange(mediaRange, mediaType string) int {
+	if mediaRange == mediaType {
+		return 2
+	}
+	if mediaRange == "*/*" {
+		return 0
+	}
+	slash := strings.Index(mediaType, "/")
+	if strings.HasSuffix(mediaRange, "/*") && mediaRange[:len(mediaRange)-1] == mediaType[:slash+1] {
+		return 1
+	}
+	return -1
+}
+
+const base64Encoding = "base64"
+
+// newGetResponse wraps the value of the key for a JSON response. JSON
+// strings can only hold text, so values that aren't valid UTF-8 are sent
+// base64-encoded instead of having their bytes replaced.
+func newGetResponse(key, value string) getResponse {
+	if utf8.ValidString(value) {
+		return getResponse{Key: key, Value: value}
+	}
+	return getResponse{
+		Key:      key,
+		Value:    base64.StdEncoding.EncodeToString([]byte(value)),
+		Encoding: base64Encoding,
+	}
+}
+
+// decodeValue returns the value of a JSON request in its encoding.
+func decodeValue(value, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case base64Encoding:
+		data, err := base64.StdEncoding.DecodeString(value)
+		return string(data), err
+	default:
+		return "", fmt.Errorf("unknown value encoding %q", encoding)
+	}
+}
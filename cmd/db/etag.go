@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Alexander3006/design-practice-2/cmd/datastore"
+)
+
+// Versions of keys are sent to clients as entity tags.
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+func parseETag(tag string) (uint64, bool) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0, false
+	}
+	version, err := strconv.ParseUint(unquoted, 10, 64)
+	return version, err == nil
+}
+
+// ifMatch returns the condition of the If-Match header lines: "*" matches
+// any existing key, a list of tags matches the versions they carry. Tags
+// that aren't versions of this server never match.
+func ifMatch(lines []string) datastore.Condition {
+	header := strings.Join(lines, ",")
+	if strings.TrimSpace(header) == "*" {
+		return datastore.Exists
+	}
+	var versions []uint64
+	for _, tag := range strings.Split(header, ",") {
+		if version, ok := parseETag(tag); ok {
+			versions = append(versions, version)
+		}
+	}
+	return datastore.VersionIn(versions...)
+}
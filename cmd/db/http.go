@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Alexander3006/design-practice-2/cmd/datastore"
 	"github.com/Alexander3006/design-practice-2/httptools"
@@ -16,20 +25,74 @@ import (
 const KB = 1024
 const MB = KB * 1024
 
+const defaultScanLimit = 100
+const maxScanLimit = 1000
+
 var port = flag.Int("p", 8070, "server's port")
 var path = flag.String("d", ".db", "database's directory path")
 var segment_size = flag.Int("s", 10*MB, "segment size in bytes")
+var strict = flag.Bool("strict", false, "fail on partially written records instead of truncating them")
+var syncMode = flag.String("sync", "never", "when writes are flushed to disk: never, always or interval")
+var syncInterval = flag.Duration("sync-interval", 100*time.Millisecond, "flush interval of the interval sync mode")
+var cacheSize = flag.Int("cache", 0, "value cache size in bytes, 0 disables the cache")
+var codec = flag.String("compress", "none", "codec of stored values: none or flate")
+var compressThreshold = flag.Int("compress-threshold", 256, "smallest value size in bytes that gets compressed")
+var keyFile = flag.String("key-file", "", "file with the keys values are encrypted with, empty to store them in plaintext")
+var maxKeySize = flag.Int("max-key-size", datastore.DefaultMaxKeySize, "largest key size in bytes")
+var maxValueSize = flag.Int64("max-value-size", datastore.DefaultMaxValueSize, "largest value size in bytes")
+var changeRetention = flag.Int("change-retention", datastore.DefaultChangeRetention, "number of latest changes kept for watchers to resume from")
+var readOnly = flag.Bool("read-only", false, "serve the database for reading only, next to other read-only instances")
 
 type getResponse struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// Encoding of the value, "base64" for values that aren't valid UTF-8
+	// and empty for values sent as they are.
+	Encoding string `json:"encoding,omitempty"`
+	// Media type the value was stored with, if any.
+	ContentType string `json:"contentType,omitempty"`
 }
 
 type postRequest struct {
 	Value string `json:"value"`
+	// Encoding of the value, empty or "base64".
+	Encoding string `json:"encoding"`
+	// Time to live of the key in seconds, zero if it never expires.
+	TTL int64 `json:"ttl"`
+}
+
+type scanResponse struct {
+	Items []getResponse `json:"items"`
+	// Cursor to pass to get the next page, empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+type batchOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Encoding of the value, empty or "base64".
+	Encoding string `json:"encoding"`
+}
+
+type batchRequest struct {
+	Ops []batchOperation `json:"ops"`
+}
+
+type changeEvent struct {
+	Key      string `json:"key"`
+	Sequence uint64 `json:"sequence"`
+}
+
+type bucketsResponse struct {
+	Buckets []string `json:"buckets"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestore(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
 	err := os.MkdirAll(*path, os.ModePerm)
@@ -38,7 +101,38 @@ func main() {
 		return
 	}
 
-	db, err := datastore.NewDb(*path, int64(*segment_size))
+	mode, err := datastore.ParseSyncMode(*syncMode)
+	if err != nil {
+		log.Fatalf("error parsing sync mode: %s", err)
+		return
+	}
+	durability := datastore.Durability{Mode: mode, Interval: *syncInterval}
+
+	valueCodec, err := datastore.ParseCodec(*codec)
+	if err != nil {
+		log.Fatalf("error parsing codec: %s", err)
+		return
+	}
+	compression := datastore.Compression{Codec: valueCodec, Threshold: *compressThreshold}
+
+	var keyring *datastore.Keyring
+	if *keyFile != "" {
+		keyring, err = datastore.LoadKeyring(*keyFile)
+		if err != nil {
+			log.Fatalf("error loading keys: %s", err)
+			return
+		}
+	}
+
+	db, err := datastore.NewDb(*path, int64(*segment_size),
+		datastore.WithStrictRecovery(*strict),
+		datastore.WithDurability(durability),
+		datastore.WithCache(int64(*cacheSize)),
+		datastore.WithCompression(compression),
+		datastore.WithEncryption(keyring),
+		datastore.WithLimits(datastore.Limits{MaxKeySize: *maxKeySize, MaxValueSize: *maxValueSize}),
+		datastore.WithChangeRetention(*changeRetention),
+		datastore.WithReadOnly(*readOnly))
 	if err != nil {
 		log.Fatalf("error creating db: %s", err)
 		return
@@ -47,75 +141,607 @@ func main() {
 	_ = db.Put("key", "G1gg1L3s")
 
 	r := mux.NewRouter()
-	r.HandleFunc("/db/{key}", func(rw http.ResponseWriter, r *http.Request) {
+	// Keys are served under /db/{bucket}/{key}, /db/{key} is a key of the
+	// default bucket.
+	handleKey := func(f http.HandlerFunc, method string) {
+		r.HandleFunc("/db/{key}", f).Methods(method)
+		r.HandleFunc("/db/{bucket}/{key}", f).Methods(method)
+	}
+
+	handleKey(func(rw http.ResponseWriter, r *http.Request) {
 		log.Printf("Get request to %s", r.URL)
 		vars := mux.Vars(r)
 		key := vars["key"]
 
-		value, err := db.Get(key)
+		rw.Header().Set("content-type", jsonType)
 
-		rw.Header().Set("content-type", "application/json")
+		bucket, ok := routeBucket(db, rw, vars["bucket"])
+		if !ok {
+			return
+		}
+		value, err := bucket.GetStream(key)
 
-		if err != nil {
+		if err == datastore.ErrReservedKey {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err == datastore.ErrNotFound || err == datastore.ErrBucketNotFound {
 			rw.WriteHeader(http.StatusNotFound)
-		} else {
-
-			rw.WriteHeader(http.StatusOK)
+			return
+		} else if err != nil {
+			writeError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		defer value.Close()
 
-			res := getResponse{key, value}
-			err := json.NewEncoder(rw).Encode(&res)
+		// Values stored with a content type are served as they are unless
+		// JSON is asked for, others are wrapped in JSON unless the client
+		// only wants the raw bytes.
+		rawType := value.ContentType
+		if rawType == "" {
+			rawType = binaryType
+		}
+		offers := []string{jsonType, rawType}
+		if value.ContentType != "" {
+			offers = []string{rawType, jsonType}
+		}
+		contentType, ok := negotiate(r.Header.Get("accept"), offers...)
+		rw.Header().Set("vary", "accept")
+		if !ok {
+			rw.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		rw.Header().Set("etag", formatETag(value.Version))
 
+		if contentType == rawType {
+			// The value is copied from the segment as it is read, so
+			// failures past this point only cut the response short.
+			rw.Header().Set("content-type", rawType)
+			if value.Size >= 0 {
+				rw.Header().Set("content-length", strconv.FormatInt(value.Size, 10))
+			}
+			rw.WriteHeader(http.StatusOK)
+			_, err = io.Copy(rw, value)
+		} else {
+			var data []byte
+			data, err = ioutil.ReadAll(value)
 			if err != nil {
-				log.Printf("Error while serving request: %s", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+			} else {
+				rw.WriteHeader(http.StatusOK)
+				res := newGetResponse(key, string(data))
+				res.ContentType = value.ContentType
+				err = json.NewEncoder(rw).Encode(&res)
 			}
 		}
+		if err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
 
-	}).Methods("GET")
+	}, "GET")
 
-	r.HandleFunc("/db/{key}", func(rw http.ResponseWriter, r *http.Request) {
+	handleKey(func(rw http.ResponseWriter, r *http.Request) {
 		log.Printf("Post request to %s", r.URL)
 		vars := mux.Vars(r)
 		key := vars["key"]
 
 		rw.Header().Set("content-type", "application/json")
 
-		var body postRequest
-		err := json.NewDecoder(r.Body).Decode(&body)
-		if err != nil {
+		bucket, ok := routeBucket(db, rw, vars["bucket"])
+		if !ok {
+			return
+		}
+
+		body := &requestBody{r: r.Body}
+		value, opts, err := readValue(r, body, db.Limits())
+		if isTooLarge(err) {
+			writeError(rw, http.StatusRequestEntityTooLarge, err)
+			return
+		} else if err != nil {
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		err = db.Put(key, body.Value)
-		if err != nil {
+		var version uint64
+		if match := r.Header.Values("if-match"); len(match) > 0 {
+			version, err = bucket.PutStreamIf(key, ifMatch(match), value, opts...)
+		} else if r.Header.Get("if-none-match") == "*" {
+			version, err = bucket.PutIfAbsentStream(key, value, opts...)
+		} else {
+			version, err = bucket.PutStream(key, value, opts...)
+		}
+
+		if body.err != nil || err == datastore.ErrReservedKey {
+			rw.WriteHeader(http.StatusBadRequest)
+		} else if err == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+		} else if isTooLarge(err) {
+			writeError(rw, http.StatusRequestEntityTooLarge, err)
+		} else if err == datastore.ErrVersionMismatch {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+		} else if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 		} else {
+			rw.Header().Set("etag", formatETag(version))
 			rw.WriteHeader(http.StatusOK)
 		}
 
-	}).Methods("POST")
+	}, "POST")
 
-	r.HandleFunc("/db/{key}", func(rw http.ResponseWriter, r *http.Request) {
+	handleKey(func(rw http.ResponseWriter, r *http.Request) {
 		log.Printf("Delete request to %s", r.URL)
 		vars := mux.Vars(r)
 		key := vars["key"]
 
-		err = db.Delete(key)
 		rw.Header().Set("content-type", "application/json")
 
+		bucket, ok := routeBucket(db, rw, vars["bucket"])
+		if !ok {
+			return
+		}
+		var err error
+		if match := r.Header.Values("if-match"); len(match) > 0 {
+			err = bucket.DeleteIf(key, ifMatch(match))
+		} else {
+			err = bucket.Delete(key)
+		}
+
+		if err == datastore.ErrReservedKey {
+			rw.WriteHeader(http.StatusBadRequest)
+		} else if err == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+		} else if isTooLarge(err) {
+			writeError(rw, http.StatusRequestEntityTooLarge, err)
+		} else if err == datastore.ErrVersionMismatch {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+		} else if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+		} else {
+			rw.WriteHeader(http.StatusOK)
+		}
+
+	}, "DELETE")
+
+	r.HandleFunc("/db", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Scan request to %s", r.URL)
+		query := r.URL.Query()
+		prefix := query.Get("prefix")
+
+		rw.Header().Set("content-type", "application/json")
+
+		bucket, ok := routeBucket(db, rw, query.Get("bucket"))
+		if !ok {
+			return
+		}
+		limit := defaultScanLimit
+		if l := query.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n <= 0 || n > maxScanLimit {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		start := query.Get("start")
+		if cursor := query.Get("cursor"); cursor != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			start = string(decoded)
+		}
+		if start < prefix {
+			start = prefix
+		}
+
+		// One more key is read to know whether there is a next page.
+		it := bucket.Scan(start, datastore.PrefixEnd(prefix), datastore.ScanOptions{Limit: limit + 1})
+		res := scanResponse{Items: []getResponse{}}
+		for it.Next() {
+			if len(res.Items) == limit {
+				// Keys go in order, so the next page starts right after
+				// the last returned key.
+				next := res.Items[len(res.Items)-1].Key + "\x00"
+				res.Next = base64.RawURLEncoding.EncodeToString([]byte(next))
+				break
+			}
+			res.Items = append(res.Items, newGetResponse(it.Key(), it.Value()))
+		}
+		if it.Err() == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		} else if it.Err() != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		err := json.NewEncoder(rw).Encode(&res)
 		if err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+
+	}).Methods("GET")
+
+	r.HandleFunc("/db", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Batch request to %s", r.URL)
+
+		rw.Header().Set("content-type", "application/json")
+
+		bucket, ok := routeBucket(db, rw, r.URL.Query().Get("bucket"))
+		if !ok {
+			return
+		}
+		var body batchRequest
+		err := decodeJSON(r.Body, db.Limits(), &body)
+		if isTooLarge(err) {
+			writeError(rw, http.StatusRequestEntityTooLarge, err)
+			return
+		} else if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		batch := bucket.NewBatch()
+		for _, op := range body.Ops {
+			switch op.Op {
+			case "put":
+				value, err := decodeValue(op.Value, op.Encoding)
+				if err != nil {
+					rw.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				batch.Put(op.Key, value)
+			case "delete":
+				batch.Delete(op.Key)
+			default:
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = batch.Commit()
+		if err == datastore.ErrReservedKey {
+			rw.WriteHeader(http.StatusBadRequest)
+		} else if err == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+		} else if isTooLarge(err) {
+			writeError(rw, http.StatusRequestEntityTooLarge, err)
+		} else if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+		} else {
+			rw.WriteHeader(http.StatusOK)
+		}
+
+	}).Methods("POST")
+
+	r.HandleFunc("/watch", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Watch request to %s", r.URL)
+		query := r.URL.Query()
+
+		bucket, ok := routeBucket(db, rw, query.Get("bucket"))
+		if !ok {
+			return
+		}
+		// Reconnecting clients resume from the last event they got.
+		since := db.Sequence()
+		if s := query.Get("since"); s != "" || r.Header.Get("last-event-id") != "" {
+			if s == "" {
+				s = r.Header.Get("last-event-id")
+			}
+			var err error
+			since, err = strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		watcher, err := bucket.Watch(query.Get("prefix"), since)
+		if err == datastore.ErrSequenceExpired || err == datastore.ErrUnknownSequence {
+			writeError(rw, http.StatusGone, err)
+			return
+		} else if err == datastore.ErrReservedKey {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// The stream goes on until the client is gone, which keep-alives
+		// notice. Clients reconnect and resume from the last event id.
+		err = streamChanges(rw, r, watcher)
+		if err != nil {
+			log.Printf("Watch stopped: %s", err)
+		}
+
+	}).Methods("GET")
+
+	r.HandleFunc("/admin/buckets", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Buckets request to %s", r.URL)
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		err := json.NewEncoder(rw).Encode(bucketsResponse{db.Buckets()})
+		if err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+
+	}).Methods("GET")
+
+	r.HandleFunc("/admin/buckets/{bucket}", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Create bucket request to %s", r.URL)
+
+		_, err := db.CreateBucket(mux.Vars(r)["bucket"])
+		if err == datastore.ErrBucketExists {
+			rw.WriteHeader(http.StatusConflict)
+		} else if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+		} else {
+			rw.WriteHeader(http.StatusCreated)
+		}
+
+	}).Methods("POST")
+
+	r.HandleFunc("/admin/buckets/{bucket}", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Drop bucket request to %s", r.URL)
+
+		err := db.DropBucket(mux.Vars(r)["bucket"])
+		if err == datastore.ErrBucketNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+		} else if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
 		} else {
 			rw.WriteHeader(http.StatusOK)
 		}
 
 	}).Methods("DELETE")
 
+	r.HandleFunc("/admin/compact", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Compaction request to %s", r.URL)
+
+		err := db.Compact()
+		if err != nil {
+			log.Printf("Compaction failed: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+		} else {
+			rw.WriteHeader(http.StatusOK)
+		}
+
+	}).Methods("POST")
+
+	r.HandleFunc("/admin/backup", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Backup request to %s", r.URL)
+
+		rw.Header().Set("content-type", "application/x-tar")
+		rw.Header().Set("content-disposition", `attachment; filename="backup.tar"`)
+		// The status is sent with the first part of the archive. A failure
+		// after it aborts the connection before the response is complete,
+		// so clients get an error rather than a short archive.
+		w := &responseBody{w: rw}
+		err := db.Snapshot(w)
+		if err != nil {
+			log.Printf("Backup failed: %s", err)
+			if !w.started {
+				writeError(rw, http.StatusInternalServerError, err)
+				return
+			}
+			panic(http.ErrAbortHandler)
+		}
+
+	}).Methods("GET")
+
+	r.HandleFunc("/admin/stats", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("Stats request to %s", r.URL)
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		err := json.NewEncoder(rw).Encode(db.Stats())
+		if err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+
+	}).Methods("GET")
+
+	if *readOnly {
+		r.Use(rejectWrites)
+	}
+
 	h := new(http.ServeMux)
 
 	h.Handle("/", r)
 
-	server := httptools.CreateServer(*port, h)
+	// Values and backups are streamed, so transferring them isn't cut off
+	// by a deadline.
+	server := httptools.CreateStreamingServer(*port, h)
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+// routeBucket returns the bucket of the name, the default one for an empty
+// name. Unknown buckets are answered with 404 Not Found.
+func routeBucket(db *datastore.Db, rw http.ResponseWriter, name string) (*datastore.Bucket, bool) {
+	if name == "" {
+		name = datastore.DefaultBucket
+	}
+	bucket, err := db.Bucket(name)
+	if err != nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	return bucket, true
+}
+
+// keepAliveInterval is how often a watch stream without changes sends a
+// comment, so a gone client is noticed.
+const keepAliveInterval = 5 * time.Second
+
+// streamChanges sends the changes read by the watcher as server-sent
+// events named put or delete. Changes of a batch share a sequence, so only
+// the last event of a sequence carries it as the event id to resume from.
+func streamChanges(rw http.ResponseWriter, r *http.Request, watcher *datastore.Watcher) error {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return fmt.Errorf("streaming isn't supported")
+	}
+	rw.Header().Set("content-type", "text/event-stream")
+	rw.Header().Set("cache-control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), keepAliveInterval)
+		changes, err := watcher.Next(ctx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			_, err = io.WriteString(rw, ": keep-alive\n\n")
+		} else if err == nil {
+			for i, c := range changes {
+				event := "put"
+				if c.Deleted {
+					event = "delete"
+				}
+				data, _ := json.Marshal(changeEvent{c.Key, c.Sequence})
+				if i == len(changes)-1 {
+					_, err = fmt.Fprintf(rw, "id: %d\n", c.Sequence)
+				}
+				if err == nil {
+					_, err = fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, data)
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err == datastore.ErrSequenceExpired {
+			// The client fell behind, it gets the error in an event as
+			// the status is already sent.
+			data, _ := json.Marshal(errorResponse{err.Error()})
+			fmt.Fprintf(rw, "event: error\ndata: %s\n\n", data)
+			flusher.Flush()
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+	}
+}
+
+// readValue returns a reader of the value posted to a key. JSON bodies
+// carry the value, base64-encoded if it isn't text, with its TTL, bodies
+// of any other content type are the value itself and are stored with their
+// content type, the TTL then comes from the query. Such values are
+// streamed to the database as they are received.
+func readValue(r *http.Request, body io.Reader, limits datastore.Limits) (io.Reader, []datastore.WriteOption, error) {
+	var opts []datastore.WriteOption
+	contentType := r.Header.Get("content-type")
+	wrapped, err := isJSON(contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	var req postRequest
+	value := body
+	if wrapped {
+		err = decodeJSON(body, limits, &req)
+		if err == nil {
+			req.Value, err = decodeValue(req.Value, req.Encoding)
+		}
+		value = strings.NewReader(req.Value)
+	} else {
+		opts = append(opts, datastore.WithContentType(contentType))
+		if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+			req.TTL, err = strconv.ParseInt(ttl, 10, 64)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.TTL < 0 {
+		return nil, nil, fmt.Errorf("negative TTL")
+	}
+	if req.TTL > 0 {
+		opts = append(opts, datastore.WithTTL(time.Duration(req.TTL)*time.Second))
+	}
+	return value, opts, nil
+}
+
+// maxJSONOverhead is how much longer than the largest value a JSON
+// request may be.
+const maxJSONOverhead = 64 * KB
+
+// decodeJSON decodes a JSON request body. The body is decoded in memory, so
+// it may only be a little longer than the largest value.
+func decodeJSON(body io.Reader, limits datastore.Limits, v interface{}) error {
+	limit := limits.MaxValueSize + maxJSONOverhead
+	lr := &io.LimitedReader{R: body, N: limit + 1}
+	err := json.NewDecoder(lr).Decode(v)
+	if lr.N == 0 {
+		return &datastore.ErrTooLarge{What: "request", Size: limit + 1, Limit: limit}
+	}
+	return err
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeError answers with the status and the error in a JSON body.
+func writeError(rw http.ResponseWriter, status int, err error) {
+	rw.Header().Set("content-type", jsonType)
+	rw.WriteHeader(status)
+	encodeErr := json.NewEncoder(rw).Encode(errorResponse{err.Error()})
+	if encodeErr != nil {
+		log.Printf("Error while serving request: %s", encodeErr)
+	}
+}
+
+func isTooLarge(err error) bool {
+	var tooLarge *datastore.ErrTooLarge
+	return errors.As(err, &tooLarge)
+}
+
+// requestBody remembers the error of reading a request body, so a client
+// that fails to send its value gets 400 Bad Request back rather than a
+// database error.
+type requestBody struct {
+	r   io.Reader
+	err error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// responseBody remembers whether a response body was started, after which
+// its status can't be changed anymore.
+type responseBody struct {
+	w       io.Writer
+	started bool
+}
+
+func (b *responseBody) Write(p []byte) (int, error) {
+	b.started = true
+	return b.w.Write(p)
+}
+
+// rejectWrites answers every request that would change the database with
+// 405 Method Not Allowed.
+func rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rw.Header().Set("allow", "GET, HEAD")
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
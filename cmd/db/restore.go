@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/Alexander3006/design-practice-2/cmd/datastore"
+)
+
+// runRestore unpacks a backup taken with GET /admin/backup into an empty
+// database directory:
+//
+//	db restore -d <dir> [archive]
+//
+// The archive is read from the standard input when it isn't given.
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := flags.String("d", ".db", "directory to restore the database into")
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatalf("error opening backup: %s", err)
+		}
+		defer f.Close()
+		in = f
+	}
+	err := datastore.Restore(in, *dir)
+	if err != nil {
+		log.Fatalf("error restoring backup: %s", err)
+	}
+	log.Printf("Restored backup into %s", *dir)
+}
@@ -3,7 +3,7 @@ module github.com/Alexander3006/design-practice-2
 go 1.15
 
 require (
-	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/gorilla/mux v1.8.0
 	github.com/roman-mazur/design-practice-2-template v0.0.0-20210409213423-4305d6876bbb // indirect
 	github.com/stretchr/testify v1.7.0
 )
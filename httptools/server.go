@@ -34,3 +34,18 @@ func CreateServer(port int, handler http.Handler) Server {
 		},
 	}
 }
+
+// CreateStreamingServer creates a server for handlers streaming long
+// bodies, which may take any time to transfer. Only reading the request
+// headers is limited in time, and idle connections are closed.
+func CreateStreamingServer(port int, handler http.Handler) Server {
+	return server{
+		httpServer: &http.Server{
+			Addr:              fmt.Sprintf(":%d", port),
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       time.Minute,
+			MaxHeaderBytes:    1 << 20,
+		},
+	}
+}